@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrAttestationRequired is returned for credentials registered without an
+	// attestation statement while a metadata blob is configured
+	ErrAttestationRequired = errors.New("authenticator attestation is required")
+	// ErrAuthenticatorNotAllowed is returned for credentials whose AAGUID is
+	// denied or missing from the allow list
+	ErrAuthenticatorNotAllowed = errors.New("authenticator is not allowed")
+)
+
+// parseConveyance validates an attestation conveyance preference
+func parseConveyance(value string) (protocol.ConveyancePreference, error) {
+	switch preference := protocol.ConveyancePreference(strings.ToLower(value)); preference {
+	case protocol.PreferNoAttestation,
+		protocol.PreferIndirectAttestation,
+		protocol.PreferDirectAttestation,
+		protocol.PreferEnterpriseAttestation:
+		return preference, nil
+	}
+
+	return "", fmt.Errorf("unsupported attestation conveyance %q, use none, indirect, direct or enterprise", value)
+}
+
+// parseAAGUIDs parses a comma separated list of authenticator AAGUIDs
+func parseAAGUIDs(value string) ([]uuid.UUID, error) {
+	var aaguids []uuid.UUID
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		aaguid, err := uuid.Parse(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AAGUID %q", item)
+		}
+
+		aaguids = append(aaguids, aaguid)
+	}
+
+	return aaguids, nil
+}
+
+// metadataRoot is the base64 DER trust anchor the certificate chains of
+// metadata blobs have to lead to
+var metadataRoot = metadata.ProductionMDSRoot
+
+// loadMetadataBlob reads a FIDO Metadata Service (MDS3) blob from a local file
+//
+// The file holds the JWT served by the Metadata Service, whose signature is
+// verified against the x5c certificate chain and the Metadata Service root.
+// The certificate revocation lists would have to be fetched from the
+// network, so revocation isn't checked: download the blob from the Metadata
+// Service directly, then point WEBAUTHN_MDS_FILE at it.
+func loadMetadataBlob(path string) (*metadata.Metadata, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw = bytes.TrimSpace(raw)
+
+	if bytes.HasPrefix(raw, []byte("{")) {
+		return nil, errors.New("metadata blob is an unsigned JSON payload, use the JWT served by the Metadata Service")
+	}
+
+	claims, err := verifyMetadataJWT(string(raw), metadataRoot)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata blob signature: %w", err)
+	}
+
+	var payload metadata.PayloadJSON
+	if err := json.Unmarshal(claims, &payload); err != nil {
+		return nil, fmt.Errorf("invalid metadata blob payload: %w", err)
+	}
+
+	decoder, err := metadata.NewDecoder(metadata.WithIgnoreEntryParsingErrors())
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.Parse(&payload)
+}
+
+// verifyMetadataJWT checks the signature of a metadata blob JWT with the
+// leaf of its x5c header, which has to chain up to root, and returns the
+// payload
+func verifyMetadataJWT(token string, root string) ([]byte, error) {
+	rootDER, err := base64.StdEncoding.DecodeString(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root certificate: %w", err)
+	}
+
+	rootCertificate, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root certificate: %w", err)
+	}
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512"}))
+
+	_, err = parser.Parse(token, func(token *jwt.Token) (any, error) {
+		x5c, ok := token.Header["x5c"].([]any)
+		if !ok || len(x5c) == 0 {
+			return nil, errors.New("missing x5c certificate chain")
+		}
+
+		var chain []*x509.Certificate
+		for _, item := range x5c {
+			encoded, ok := item.(string)
+			if !ok {
+				return nil, errors.New("invalid x5c certificate")
+			}
+
+			der, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("invalid x5c certificate: %w", err)
+			}
+
+			certificate, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid x5c certificate: %w", err)
+			}
+
+			chain = append(chain, certificate)
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(rootCertificate)
+
+		intermediates := x509.NewCertPool()
+		for _, certificate := range chain[1:] {
+			intermediates.AddCert(certificate)
+		}
+
+		if _, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return nil, fmt.Errorf("untrusted x5c certificate chain: %w", err)
+		}
+
+		return chain[0].PublicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the verified payload is decoded as is rather than from the generic claims
+	parts := strings.Split(token, ".")
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+// checkAttestationPolicy applies the configured attestation requirements and
+// AAGUID lists to a newly verified credential
+//
+// The AAGUID is only trustworthy when the attestation was verified against
+// metadata, otherwise the lists merely steer honest clients.
+func checkAttestationPolicy(config *AppConfig, credential *webauthn.Credential) error {
+	if config.MetadataFile != "" && (credential.AttestationType == "" || credential.AttestationType == string(protocol.AttestationFormatNone)) {
+		return ErrAttestationRequired
+	}
+
+	if len(config.AAGUIDAllowList) == 0 && len(config.AAGUIDDenyList) == 0 {
+		return nil
+	}
+
+	aaguid, err := uuid.FromBytes(credential.Authenticator.AAGUID)
+	if err != nil {
+		aaguid = uuid.Nil
+	}
+
+	for _, denied := range config.AAGUIDDenyList {
+		if aaguid == denied {
+			return fmt.Errorf("%w: %s", ErrAuthenticatorNotAllowed, aaguid)
+		}
+	}
+
+	if len(config.AAGUIDAllowList) == 0 {
+		return nil
+	}
+
+	for _, allowed := range config.AAGUIDAllowList {
+		if aaguid == allowed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrAuthenticatorNotAllowed, aaguid)
+}
+
+// isAttestationError reports whether a registration failed on the attestation
+// statement or its metadata rather than on the ceremony itself
+func isAttestationError(err error) bool {
+	var protocolErr *protocol.Error
+	if !errors.As(err, &protocolErr) {
+		return false
+	}
+
+	switch protocolErr.Type {
+	case protocol.ErrAttestation.Type, protocol.ErrInvalidAttestation.Type, protocol.ErrAttestationCertificate.Type:
+		return true
+	}
+
+	return false
+}
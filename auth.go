@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/go-webauthn/webauthn/metadata/providers/memory"
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/pocketbase/pocketbase/core"
 )
@@ -13,15 +16,63 @@ type AuthService struct {
 	datastore PasskeyStore
 	logger    Logger
 	config    *AppConfig
+
+	requestLimiter *RateLimiter
+	failureLimiter *RateLimiter
+	secretCipher   *SecretCipher
 }
 
 // NewAuthService creates a new authentication service
 func NewAuthService(config *AppConfig, logger Logger) (*AuthService, error) {
+	rpID := config.RPID
+	if rpID == "" {
+		rpID = config.Host
+	}
+
+	rpName := config.RPName
+	if rpName == "" {
+		rpName = defaultRPName
+	}
+
+	if err := validateRPOrigins(rpID, config.RPOrigins()); err != nil {
+		return nil, fmt.Errorf("invalid WebAuthn origins: %w", err)
+	}
+
 	// Configure WebAuthn
 	wconfig := &webauthn.Config{
-		RPDisplayName: "PB Experiments WebAuthn",
-		RPID:          config.Host,
-		RPOrigins:     []string{config.Origin},
+		RPDisplayName: rpName,
+		RPID:          rpID,
+		RPOrigins:     config.RPOrigins(),
+		// Requested attestation, verified against the metadata blob when configured
+		AttestationPreference: config.AttestationConveyance,
+		// Enforced timeouts make SessionData.Expires meaningful to the session stores
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true},
+			Registration: webauthn.TimeoutConfig{Enforce: true},
+		},
+	}
+
+	// A zero timeout keeps the library defaults
+	if config.WebAuthnTimeout > 0 {
+		wconfig.Timeouts.Login.Timeout = config.WebAuthnTimeout
+		wconfig.Timeouts.Login.TimeoutUVD = config.WebAuthnTimeout
+		wconfig.Timeouts.Registration.Timeout = config.WebAuthnTimeout
+		wconfig.Timeouts.Registration.TimeoutUVD = config.WebAuthnTimeout
+	}
+
+	if config.MetadataFile != "" {
+		blob, err := loadMetadataBlob(config.MetadataFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load metadata blob %s: %w", config.MetadataFile, err)
+		}
+		if time.Now().After(blob.Parsed.NextUpdate) {
+			logger.Printf("[WARN] WebAuthn metadata blob %s is past its next update (%s)", config.MetadataFile, blob.Parsed.NextUpdate.Format(time.DateOnly))
+		}
+
+		wconfig.MDS, err = memory.New(memory.WithMetadata(blob.ToMap()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize metadata provider: %w", err)
+		}
 	}
 
 	webAuthn, err := webauthn.New(wconfig)
@@ -30,12 +81,53 @@ func NewAuthService(config *AppConfig, logger Logger) (*AuthService, error) {
 	}
 
 	return &AuthService{
-		webAuthn: webAuthn,
-		logger:   logger,
-		config:   config,
+		webAuthn:       webAuthn,
+		logger:         logger,
+		config:         config,
+		requestLimiter: NewRateLimiter(config.RequestRateLimit),
+		failureLimiter: NewRateLimiter(config.FailureRateLimit),
+		secretCipher:   NewSecretCipher(config.TOTPEncryptionKeys),
 	}, nil
 }
 
+// RegistrationOptions returns the configured registration ceremony options
+// for the user
+//
+// The resident key requirement defaults to preferred so that passkeys can be
+// used with the usernameless login flow.
+func (a *AuthService) RegistrationOptions(user PasskeyUser) []webauthn.RegistrationOption {
+	residentKey := a.config.ResidentKey
+	if residentKey == "" {
+		residentKey = protocol.ResidentKeyRequirementPreferred
+	}
+
+	options := []webauthn.RegistrationOption{
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			AuthenticatorAttachment: a.config.AuthenticatorAttachment,
+			UserVerification:        a.config.UserVerification,
+		}),
+		webauthn.WithResidentKeyRequirement(residentKey),
+	}
+
+	if a.config.ExcludeCredentials {
+		exclusions := webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()
+		options = append(options, webauthn.WithExclusions(exclusions))
+	}
+
+	return options
+}
+
+// LoginOptions returns the configured login ceremony options
+func (a *AuthService) LoginOptions() []webauthn.LoginOption {
+	if a.config.UserVerification == "" {
+		return nil
+	}
+
+	return []webauthn.LoginOption{
+		webauthn.WithUserVerification(a.config.UserVerification),
+	}
+}
+
 // SetDatastore sets the datastore for the auth service
 func (a *AuthService) SetDatastore(datastore PasskeyStore) {
 	a.datastore = datastore
@@ -56,6 +148,26 @@ func (a *AuthService) GetLogger() Logger {
 	return a.logger
 }
 
+// GetConfig returns the application configuration
+func (a *AuthService) GetConfig() *AppConfig {
+	return a.config
+}
+
+// GetRequestLimiter returns the per client IP request rate limiter
+func (a *AuthService) GetRequestLimiter() *RateLimiter {
+	return a.requestLimiter
+}
+
+// GetFailureLimiter returns the rate limiter for failed verification attempts
+func (a *AuthService) GetFailureLimiter() *RateLimiter {
+	return a.failureLimiter
+}
+
+// GetSecretCipher returns the cipher protecting TOTP secrets at rest
+func (a *AuthService) GetSecretCipher() *SecretCipher {
+	return a.secretCipher
+}
+
 // GetTOTPIssuer returns the TOTP issuer from config
 func (a *AuthService) GetTOTPIssuer() string {
 	return a.config.TOTPIssuer
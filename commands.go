@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"text/tabwriter"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+)
+
+// newTOTPReencryptCommand returns the command sealing every stored TOTP
+// secret with the active TOTP_ENCRYPTION_KEYS key, to be run after adding
+// or rotating keys
+func newTOTPReencryptCommand(app core.App, cipher *SecretCipher) *cobra.Command {
+	return &cobra.Command{
+		Use:          "totp-reencrypt",
+		Short:        "Encrypts stored TOTP secrets with the active TOTP_ENCRYPTION_KEYS key",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !cipher.Enabled() {
+				return errors.New("env TOTP_ENCRYPTION_KEYS is not set")
+			}
+
+			updated, err := reencryptTOTPSecrets(app, cipher)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Re-encrypted the TOTP secrets of %d user(s)\n", updated)
+
+			return nil
+		},
+	}
+}
+
+// newConfigCommand returns the config commands, which load the configuration
+// like the server does so that deployments can be validated before they go
+// live
+func newConfigCommand(loader *ConfigLoader) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "config",
+		Short: "Validates and prints the configuration",
+	}
+
+	command.AddCommand(&cobra.Command{
+		Use:          "check",
+		Short:        "Loads the configuration and lists every problem",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := loader.Load()
+			if err != nil {
+				return printConfigProblems(cmd.OutOrStdout(), err)
+			}
+
+			// the WebAuthn settings are only checked as a whole when the
+			// server sets up its auth service
+			logger := log.New(cmd.OutOrStdout(), "", 0)
+			if _, err := NewAuthService(config, logger); err != nil {
+				return printConfigProblems(cmd.OutOrStdout(), err)
+			}
+
+			fmt.Fprintln(cmd.OutOrStdout(), "Configuration is valid")
+
+			return nil
+		},
+	})
+
+	command.AddCommand(&cobra.Command{
+		Use:          "print",
+		Short:        "Prints the effective configuration with secrets redacted and the source of every value",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolved, err := loader.resolve()
+			if err != nil {
+				return printConfigProblems(cmd.OutOrStdout(), err)
+			}
+
+			printConfig(cmd.OutOrStdout(), resolved)
+
+			if _, err := parseConfig(resolved.Env, resolved.Values); err != nil {
+				fmt.Fprintln(cmd.OutOrStdout())
+				return printConfigProblems(cmd.OutOrStdout(), err)
+			}
+
+			return nil
+		},
+	})
+
+	return command
+}
+
+// printConfig writes the resolved value and source of every setting
+func printConfig(w io.Writer, resolved *resolvedConfig) {
+	envFile := resolved.EnvFile
+	if envFile == "" {
+		envFile = "not found"
+	}
+	configFile := resolved.File
+	if configFile == "" {
+		configFile = "none"
+	}
+
+	fmt.Fprintf(w, "Environment: %s (env file: %s)\n", resolved.Env, envFile)
+	fmt.Fprintf(w, "Config file: %s\n\n", configFile)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+
+	for _, setting := range configSettings {
+		value := resolved.Values[setting.Env]
+
+		shown := fmt.Sprintf("%q", value.Value)
+		if setting.Secret && value.Value != "" {
+			shown = "[redacted]"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", setting.Env, shown, value.Source)
+	}
+
+	tw.Flush()
+}
+
+// printConfigProblems lists the problems of a configuration error and
+// returns an error for the command to exit with
+func printConfigProblems(w io.Writer, err error) error {
+	var problems []string
+
+	var errs validation.Errors
+	if errors.As(err, &errs) {
+		for key, keyErr := range errs {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, keyErr))
+		}
+		sort.Strings(problems)
+	} else {
+		problems = append(problems, err.Error())
+	}
+
+	fmt.Fprintf(w, "Configuration has %d problem(s):\n", len(problems))
+	for _, problem := range problems {
+		fmt.Fprintf(w, "  - %s\n", problem)
+	}
+
+	return errors.New("invalid configuration")
+}
+
+// reencryptTOTPSecrets re-encrypts plaintext secrets and secrets sealed with
+// older keys, returning the number of updated users
+func reencryptTOTPSecrets(app core.App, cipher *SecretCipher) (int, error) {
+	updated := 0
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		records, err := txApp.FindAllRecords("users", dbx.Or(
+			dbx.NewExp("[["+totpSecretField+"]] != ''"),
+			dbx.NewExp("[["+totpPendingSecretField+"]] != ''"),
+		))
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			changed := false
+
+			for _, field := range []string{totpSecretField, totpPendingSecretField} {
+				if !cipher.NeedsReencryption(record.GetString(field)) {
+					continue
+				}
+
+				secret, err := getTOTPSecret(cipher, record, field)
+				if err != nil {
+					return fmt.Errorf("user %s: %w", record.Id, err)
+				}
+
+				if err := setTOTPSecret(cipher, record, field, secret); err != nil {
+					return fmt.Errorf("user %s: %w", record.Id, err)
+				}
+				changed = true
+			}
+
+			if !changed {
+				continue
+			}
+
+			if err := txApp.Save(record); err != nil {
+				return fmt.Errorf("user %s: %w", record.Id, err)
+			}
+			updated++
+		}
+
+		return nil
+	})
+
+	return updated, err
+}
@@ -2,69 +2,460 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/joho/godotenv"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/google/uuid"
+	"github.com/pquerna/otp"
 )
 
+// Session store backends selectable via SESSION_STORE
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreDB     = "db"
+)
+
+// Policies applied when a passkey login reports a sign count regression
+const (
+	CloneWarningPolicyFlag  = "flag"
+	CloneWarningPolicyBlock = "block"
+)
+
+// Registration policies for anonymous passkey registration
+const (
+	// RegistrationPolicyExisting only lets signed-in users add passkeys
+	RegistrationPolicyExisting = "existing"
+	// RegistrationPolicyOpen also allows new accounts via an emailed sign-up link
+	RegistrationPolicyOpen = "open"
+)
+
+// defaultRPName is the relying party name used when none is configured
+const defaultRPName = "PB Experiments WebAuthn"
+
 // AppConfig holds application configuration
 type AppConfig struct {
-	IsDevEnv     bool
-	TOTPIssuer   string
-	Proto        string
-	Host         string
-	Port         string
-	Origin       string
+	// Env is EnvDevelopment or EnvProduction, see ConfigLoader
+	Env        string
+	IsDevEnv   bool
+	TOTPIssuer string
+	Proto      string
+	Host       string
+	Port       string
+	Origin     string
+	// Relying party identifier and name shown by authenticators, RPID
+	// defaults to Host
+	RPID   string
+	RPName string
+	// Origins lists every origin WebAuthn ceremonies are accepted from:
+	// Origin followed by WEBAUTHN_ORIGINS (see RPOrigins)
+	Origins []string
+
+	// WebAuthn ceremony session storage
+	SessionStore         string
+	SessionTTL           time.Duration
+	SessionSweepInterval time.Duration
+	SessionMaxTotal      int
+	SessionMaxPerEmail   int
+
+	// CloneWarningPolicy decides whether logins with a regressed sign count
+	// are only flagged on the credential or rejected
+	CloneWarningPolicy string
+
+	// RegistrationPolicy controls whether passkeys can create new accounts
+	RegistrationPolicy string
+
+	// TOTP code parameters, also encoded in the enrollment QR so that
+	// authenticator apps generate matching codes
+	TOTPDigits    otp.Digits
+	TOTPPeriod    uint
+	TOTPAlgorithm otp.Algorithm
+	// TOTPSkew is the number of periods before and after the current one
+	// in which a code is still accepted to tolerate clock drift
+	TOTPSkew uint
+	// TOTPQRSize is the default QR code size in pixels
+	TOTPQRSize int
+
+	// Brute-force throttling of the API routes (per client IP) and of failed
+	// verification attempts (per IP, user and MFA id)
+	RequestRateLimit RateLimitPolicy
+	FailureRateLimit RateLimitPolicy
+
+	// Authenticator selection and ceremony policy of the registration and
+	// login options; WebAuthnTimeout is also enforced server side
+	ResidentKey             protocol.ResidentKeyRequirement
+	UserVerification        protocol.UserVerificationRequirement
+	AuthenticatorAttachment protocol.AuthenticatorAttachment
+	WebAuthnTimeout         time.Duration
+	// ExcludeCredentials lists the user's passkeys at registration so that
+	// authenticators don't register twice
+	ExcludeCredentials bool
+
+	// WebAuthn attestation: the conveyance requested at registration, an
+	// optional local FIDO metadata blob to verify it against and AAGUID lists
+	AttestationConveyance protocol.ConveyancePreference
+	MetadataFile          string
+	AAGUIDAllowList       []uuid.UUID
+	AAGUIDDenyList        []uuid.UUID
+
+	// StepUpMaxAge is how long a TOTP or passkey authentication satisfies
+	// RequireStepUp before sensitive operations ask for a new one
+	StepUpMaxAge time.Duration
+
+	// TOTPEncryptionKeys encrypt TOTP secrets at rest, the first one is used
+	// for new secrets and the others only to read older ones
+	TOTPEncryptionKeys []EncryptionKey
+}
+
+// configSetting describes a configuration value by its environment
+// variable, which also names its config file key and command line flag
+type configSetting struct {
+	Env     string
+	Default string
+	Usage   string
+	// Secret values are redacted when the configuration is printed
+	Secret bool
 }
 
-// LoadConfig loads configuration from environment variables
+// fileKey returns the config file key of the setting, e.g. totp_issuer
+func (s configSetting) fileKey() string {
+	return strings.ToLower(s.Env)
+}
+
+// flagName returns the command line flag of the setting, e.g. totp-issuer
+func (s configSetting) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(s.Env), "_", "-")
+}
+
+// configSettings lists every configuration value with its default
+var configSettings = []configSetting{
+	{Env: "TOTP_ISSUER", Usage: "issuer shown by authenticator apps (required)"},
+	{Env: "PROTO", Usage: "public protocol, http or https (required)"},
+	{Env: "HOST", Usage: "public host name, without scheme or port (required)"},
+	{Env: "PORT", Usage: "public port like :8090, only part of the origin in development"},
+	{Env: "WEBAUTHN_RP_ID", Usage: "relying party ID (default HOST)"},
+	{Env: "WEBAUTHN_RP_NAME", Default: defaultRPName, Usage: "relying party name shown by authenticators"},
+	{Env: "WEBAUTHN_ORIGINS", Usage: "comma separated extra web or android:apk-key-hash: origins"},
+	{Env: "SESSION_STORE", Default: SessionStoreMemory, Usage: "ceremony session store, memory or db"},
+	{Env: "SESSION_TTL", Default: "5m", Usage: "fallback expiry of ceremony sessions"},
+	{Env: "SESSION_SWEEP_INTERVAL", Default: "1m", Usage: "how often expired ceremony sessions are purged"},
+	{Env: "SESSION_MAX_TOTAL", Default: strconv.Itoa(DefaultSessionLimits().MaxSessions), Usage: "max in-memory sessions, 0 for unlimited"},
+	{Env: "SESSION_MAX_PER_EMAIL", Default: strconv.Itoa(DefaultSessionLimits().MaxPerEmail), Usage: "max in-memory sessions per email, 0 for unlimited"},
+	{Env: "CLONE_WARNING_POLICY", Default: CloneWarningPolicyFlag, Usage: "sign count regressions, flag or block"},
+	{Env: "REGISTRATION_POLICY", Default: RegistrationPolicyExisting, Usage: "passkey registration, existing or open"},
+	{Env: "TOTP_DIGITS", Default: "6", Usage: "TOTP code length, 6 or 8"},
+	{Env: "TOTP_PERIOD", Default: "30", Usage: "TOTP period in seconds"},
+	{Env: "TOTP_ALGORITHM", Default: "SHA1", Usage: "TOTP algorithm, SHA1, SHA256 or SHA512"},
+	{Env: "TOTP_SKEW", Default: "1", Usage: "TOTP periods accepted before and after the current one"},
+	{Env: "TOTP_QR_SIZE", Default: strconv.Itoa(defaultQRSize), Usage: "default TOTP QR code size in pixels"},
+	{Env: "RATE_LIMIT_REQUESTS", Default: "60", Usage: "API requests per window and client IP, 0 disables"},
+	{Env: "RATE_LIMIT_WINDOW", Default: "1m", Usage: "API request window"},
+	{Env: "RATE_LIMIT_FAILURES", Default: "5", Usage: "failed verifications per window, 0 disables"},
+	{Env: "RATE_LIMIT_FAILURE_WINDOW", Default: "15m", Usage: "failed verification window"},
+	{Env: "RATE_LIMIT_LOCKOUT", Default: "30s", Usage: "first lockout, doubled on repeated lockouts"},
+	{Env: "RATE_LIMIT_MAX_LOCKOUT", Default: "1h", Usage: "longest lockout"},
+	{Env: "WEBAUTHN_RESIDENT_KEY", Default: string(protocol.ResidentKeyRequirementPreferred), Usage: "discouraged, preferred or required"},
+	{Env: "WEBAUTHN_USER_VERIFICATION", Default: string(protocol.VerificationPreferred), Usage: "discouraged, preferred or required"},
+	{Env: "WEBAUTHN_AUTHENTICATOR_ATTACHMENT", Usage: "empty for any, platform or cross-platform"},
+	{Env: "WEBAUTHN_TIMEOUT", Default: "5m", Usage: "passkey ceremony timeout"},
+	{Env: "WEBAUTHN_EXCLUDE_CREDENTIALS", Default: "true", Usage: "list existing passkeys at registration"},
+	{Env: "WEBAUTHN_ATTESTATION", Default: string(protocol.PreferNoAttestation), Usage: "none, indirect, direct or enterprise"},
+	{Env: "WEBAUTHN_MDS_FILE", Usage: "local FIDO MDS3 blob verifying attestations"},
+	{Env: "WEBAUTHN_AAGUID_ALLOW", Usage: "comma separated AAGUIDs allowed to register"},
+	{Env: "WEBAUTHN_AAGUID_DENY", Usage: "comma separated AAGUIDs denied to register"},
+	{Env: "STEP_UP_MAX_AGE", Default: defaultStepUpMaxAge.String(), Usage: "how long a strong authentication satisfies step-up"},
+	{Env: "TOTP_ENCRYPTION_KEYS", Usage: "comma separated id:base64 keys encrypting TOTP secrets", Secret: true},
+}
+
+// hostPattern matches DNS host names
+var hostPattern = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+// LoadConfig loads the configuration from its defaults, the environment file
+// and environment variables, without command line flags
 func LoadConfig() (*AppConfig, error) {
-	config := &AppConfig{}
-	
-	// Determine if running in development
-	config.IsDevEnv = strings.HasPrefix(os.Args[0], os.TempDir())
+	return NewConfigLoader().Load()
+}
 
-	// Load environment file
-	if err := loadEnvFile(config.IsDevEnv); err != nil {
-		return nil, fmt.Errorf("failed to load environment file: %w", err)
-	}
+// parseConfig converts resolved values into an AppConfig, validating every
+// setting and reporting all invalid ones at once as validation.Errors
+func parseConfig(env string, values configValues) (*AppConfig, error) {
+	p := &configParser{values: values, errs: validation.Errors{}}
 
-	// Load required environment variables
-	config.TOTPIssuer = os.Getenv("TOTP_ISSUER")
-	if config.TOTPIssuer == "" {
-		return nil, fmt.Errorf("env TOTP_ISSUER not found")
+	config := &AppConfig{
+		Env:      env,
+		IsDevEnv: env == EnvDevelopment,
 	}
 
-	config.Proto = os.Getenv("PROTO")
-	config.Host = os.Getenv("HOST")
+	config.TOTPIssuer = p.required("TOTP_ISSUER")
+	config.Proto = p.choice("PROTO", "http", "https")
+	config.Host = p.host("HOST")
 
-	// Build origin URL
+	if port := p.string("PORT"); port != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(port, ":"))
+		if err != nil || n < 1 || n > 65535 {
+			p.fail("PORT", "must be a port between 1 and 65535 like :8090, got %q", port)
+		} else {
+			config.Port = fmt.Sprintf(":%d", n)
+		}
+	}
+
+	// Build origin URL, production is served on the default port behind a proxy
 	if config.IsDevEnv {
-		config.Port = os.Getenv("PORT")
 		config.Origin = fmt.Sprintf("%s://%s%s", config.Proto, config.Host, config.Port)
 	} else {
 		config.Origin = fmt.Sprintf("%s://%s", config.Proto, config.Host)
 	}
 
+	config.RPID = config.Host
+	if rpID := p.string("WEBAUTHN_RP_ID"); rpID != "" {
+		config.RPID = p.host("WEBAUTHN_RP_ID")
+	}
+	config.RPName = p.required("WEBAUTHN_RP_NAME")
+
+	// Additional origins, e.g. other subdomains or Android apps
+	extraOrigins, err := parseOrigins(p.string("WEBAUTHN_ORIGINS"))
+	p.check("WEBAUTHN_ORIGINS", err)
+
+	config.Origins = []string{config.Origin}
+	for _, origin := range extraOrigins {
+		if !slices.Contains(config.Origins, origin) {
+			config.Origins = append(config.Origins, origin)
+		}
+	}
+
+	if p.valid("PROTO", "HOST", "PORT", "WEBAUTHN_RP_ID", "WEBAUTHN_ORIGINS") {
+		p.check("WEBAUTHN_ORIGINS", validateRPOrigins(config.RPID, config.Origins))
+	}
+
+	// Ceremony session storage
+	config.SessionStore = p.choice("SESSION_STORE", SessionStoreMemory, SessionStoreDB)
+	config.SessionTTL = p.duration("SESSION_TTL")
+	config.SessionSweepInterval = p.duration("SESSION_SWEEP_INTERVAL")
+	config.SessionMaxTotal = p.int("SESSION_MAX_TOTAL")
+	config.SessionMaxPerEmail = p.int("SESSION_MAX_PER_EMAIL")
+
+	config.CloneWarningPolicy = p.choice("CLONE_WARNING_POLICY", CloneWarningPolicyFlag, CloneWarningPolicyBlock)
+	config.RegistrationPolicy = p.choice("REGISTRATION_POLICY", RegistrationPolicyExisting, RegistrationPolicyOpen)
+
+	// TOTP code parameters
+	switch digits := p.choice("TOTP_DIGITS", "6", "8"); digits {
+	case "6":
+		config.TOTPDigits = otp.DigitsSix
+	case "8":
+		config.TOTPDigits = otp.DigitsEight
+	}
+
+	config.TOTPPeriod = uint(p.int("TOTP_PERIOD"))
+	if config.TOTPPeriod == 0 && p.valid("TOTP_PERIOD") {
+		p.fail("TOTP_PERIOD", "must be a positive number of seconds")
+	}
+
+	config.TOTPAlgorithm, err = parseTOTPAlgorithm(p.string("TOTP_ALGORITHM"))
+	p.check("TOTP_ALGORITHM", err)
+
+	skew := p.int("TOTP_SKEW")
+	if p.valid("TOTP_SKEW") && (skew < 0 || skew > maxTOTPSkew) {
+		p.fail("TOTP_SKEW", "must be between 0 and %d", maxTOTPSkew)
+	}
+	config.TOTPSkew = uint(skew)
+
+	config.TOTPQRSize = p.int("TOTP_QR_SIZE")
+	if p.valid("TOTP_QR_SIZE") && (config.TOTPQRSize < minQRSize || config.TOTPQRSize > maxQRSize) {
+		p.fail("TOTP_QR_SIZE", "must be between %d and %d", minQRSize, maxQRSize)
+	}
+
+	// Brute-force throttling, both limiters share the lockout durations
+	lockout := p.duration("RATE_LIMIT_LOCKOUT")
+	maxLockout := p.duration("RATE_LIMIT_MAX_LOCKOUT")
+	if p.valid("RATE_LIMIT_LOCKOUT", "RATE_LIMIT_MAX_LOCKOUT") && maxLockout < lockout {
+		p.fail("RATE_LIMIT_MAX_LOCKOUT", "must not be shorter than RATE_LIMIT_LOCKOUT")
+	}
+
+	config.RequestRateLimit = RateLimitPolicy{
+		MaxAttempts: p.int("RATE_LIMIT_REQUESTS"),
+		Window:      p.duration("RATE_LIMIT_WINDOW"),
+		Lockout:     lockout,
+		MaxLockout:  maxLockout,
+	}
+	config.FailureRateLimit = RateLimitPolicy{
+		MaxAttempts: p.int("RATE_LIMIT_FAILURES"),
+		Window:      p.duration("RATE_LIMIT_FAILURE_WINDOW"),
+		Lockout:     lockout,
+		MaxLockout:  maxLockout,
+	}
+
+	// Passkey ceremony options
+	config.ResidentKey = protocol.ResidentKeyRequirement(p.choice("WEBAUTHN_RESIDENT_KEY",
+		string(protocol.ResidentKeyRequirementDiscouraged),
+		string(protocol.ResidentKeyRequirementPreferred),
+		string(protocol.ResidentKeyRequirementRequired),
+	))
+	config.UserVerification = protocol.UserVerificationRequirement(p.choice("WEBAUTHN_USER_VERIFICATION",
+		string(protocol.VerificationRequired),
+		string(protocol.VerificationPreferred),
+		string(protocol.VerificationDiscouraged),
+	))
+	config.AuthenticatorAttachment = protocol.AuthenticatorAttachment(p.choice("WEBAUTHN_AUTHENTICATOR_ATTACHMENT",
+		"",
+		string(protocol.Platform),
+		string(protocol.CrossPlatform),
+	))
+	config.WebAuthnTimeout = p.duration("WEBAUTHN_TIMEOUT")
+	config.ExcludeCredentials = p.bool("WEBAUTHN_EXCLUDE_CREDENTIALS")
+
+	// Attestation
+	config.AttestationConveyance, err = parseConveyance(p.string("WEBAUTHN_ATTESTATION"))
+	p.check("WEBAUTHN_ATTESTATION", err)
+
+	config.MetadataFile = p.string("WEBAUTHN_MDS_FILE")
+	if config.MetadataFile != "" && p.valid("WEBAUTHN_ATTESTATION") && config.AttestationConveyance == protocol.PreferNoAttestation {
+		p.fail("WEBAUTHN_MDS_FILE", "requires WEBAUTHN_ATTESTATION to request an attestation")
+	}
+
+	config.AAGUIDAllowList, err = parseAAGUIDs(p.string("WEBAUTHN_AAGUID_ALLOW"))
+	p.check("WEBAUTHN_AAGUID_ALLOW", err)
+
+	config.AAGUIDDenyList, err = parseAAGUIDs(p.string("WEBAUTHN_AAGUID_DENY"))
+	p.check("WEBAUTHN_AAGUID_DENY", err)
+
+	config.StepUpMaxAge = p.duration("STEP_UP_MAX_AGE")
+
+	config.TOTPEncryptionKeys, err = parseEncryptionKeys(p.string("TOTP_ENCRYPTION_KEYS"))
+	p.check("TOTP_ENCRYPTION_KEYS", err)
+
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+
 	return config, nil
 }
 
-// loadEnvFile loads the appropriate environment file
-func loadEnvFile(isDevEnv bool) error {
-	if isDevEnv {
-		return godotenv.Load()
+// configParser converts resolved setting values into typed fields, keeping
+// the first error of every invalid setting
+type configParser struct {
+	values configValues
+	errs   validation.Errors
+}
+
+// fail records an error for key unless it already has one
+func (p *configParser) fail(key string, format string, args ...any) {
+	if _, ok := p.errs[key]; !ok {
+		p.errs[key] = fmt.Errorf(format, args...)
+	}
+}
+
+// check records err for key, if any
+func (p *configParser) check(key string, err error) {
+	if err != nil {
+		p.fail(key, "%s", err.Error())
+	}
+}
+
+// valid reports whether none of keys has an error
+func (p *configParser) valid(keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := p.errs[key]; ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// string returns the trimmed value of key
+func (p *configParser) string(key string) string {
+	return strings.TrimSpace(p.values[key].Value)
+}
+
+// required returns the value of key, which must not be empty
+func (p *configParser) required(key string) string {
+	value := p.string(key)
+	if value == "" {
+		p.fail(key, "is required")
+	}
+
+	return value
+}
+
+// choice returns the value of key, which must be one of allowed
+func (p *configParser) choice(key string, allowed ...string) string {
+	value := p.string(key)
+	if !slices.Contains(allowed, value) {
+		if value == "" {
+			p.fail(key, "is required, use one of %q", allowed)
+		} else {
+			p.fail(key, "must be one of %q, got %q", allowed, value)
+		}
+	}
+
+	return value
+}
+
+// host returns the value of key, which must be a host name or IP address
+// without scheme, port or path
+func (p *configParser) host(key string) string {
+	value := strings.ToLower(p.required(key))
+	if value != "" && !hostPattern.MatchString(value) && net.ParseIP(value) == nil {
+		p.fail(key, "must be a host name without scheme, port or path, got %q", value)
+	}
+
+	return value
+}
+
+// duration returns the value of key, which must be a positive duration
+// (e.g. "90s", "5m")
+func (p *configParser) duration(key string) time.Duration {
+	value := p.string(key)
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		p.fail(key, "must be a positive duration like 90s or 5m, got %q", value)
+		return 0
+	}
+
+	return d
+}
+
+// int returns the value of key, which must be a non-negative integer
+func (p *configParser) int(key string) int {
+	value := p.string(key)
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		p.fail(key, "must be a non-negative integer, got %q", value)
+		return 0
 	}
 
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	return n
+}
+
+// bool returns the value of key, which must be true or false
+func (p *configParser) bool(key string) bool {
+	value := p.string(key)
+
+	b, err := strconv.ParseBool(value)
 	if err != nil {
-		return err
-	}
-	
-	environmentPath := filepath.Join(dir, ".env.production")
-	log.Printf("Loading production environment from: %s", environmentPath)
-	
-	return godotenv.Load(environmentPath)
-}
\ No newline at end of file
+		p.fail(key, "must be true or false, got %q", value)
+	}
+
+	return b
+}
+
+// parseTOTPAlgorithm maps a TOTP_ALGORITHM value to its otp algorithm
+func parseTOTPAlgorithm(name string) (otp.Algorithm, error) {
+	switch strings.ToUpper(name) {
+	case "SHA1":
+		return otp.AlgorithmSHA1, nil
+	case "SHA256":
+		return otp.AlgorithmSHA256, nil
+	case "SHA512":
+		return otp.AlgorithmSHA512, nil
+	}
+
+	return 0, fmt.Errorf("must be SHA1, SHA256 or SHA512, got %q", name)
+}
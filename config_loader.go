@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Environments selectable with --env or APP_ENV
+const (
+	// EnvDevelopment reads .env from the working directory and includes PORT
+	// in the origin
+	EnvDevelopment = "development"
+	// EnvProduction reads .env.production next to the executable
+	EnvProduction = "production"
+)
+
+// Sources of configuration values, in increasing precedence
+const (
+	SourceDefault = "default"
+	SourceFile    = "config file"
+	SourceEnvFile = "env file"
+	SourceEnv     = "environment"
+	SourceFlag    = "flag"
+)
+
+// configValue is the raw value of a setting and where it came from
+type configValue struct {
+	Value  string
+	Source string
+}
+
+// configValues holds the raw value of every setting by its env name
+type configValues map[string]configValue
+
+// resolvedConfig is the configuration before parsing
+type resolvedConfig struct {
+	Env string
+	// EnvFile is the environment file read, empty when it doesn't exist
+	EnvFile string
+	// File is the YAML config file read, if any
+	File   string
+	Values configValues
+}
+
+// ConfigLoader resolves the configuration from defaults, an optional YAML
+// config file, the environment file, environment variables and command line
+// flags, later sources taking precedence over earlier ones
+type ConfigLoader struct {
+	// Env is EnvDevelopment or EnvProduction, by default APP_ENV or
+	// production
+	Env string
+	// File is an optional YAML config file, by default APP_CONFIG
+	File string
+
+	flags *pflag.FlagSet
+}
+
+// NewConfigLoader creates a loader reading defaults and the environment
+func NewConfigLoader() *ConfigLoader {
+	return &ConfigLoader{}
+}
+
+// RegisterFlags adds --env, --config and a flag per setting to the
+// persistent flags of cmd
+//
+// Like PocketBase's own flags they are parsed eagerly, so that the
+// configuration can be loaded before the command executes. Parse errors are
+// left to the full parsing on Execute.
+func (l *ConfigLoader) RegisterFlags(cmd *cobra.Command) {
+	flags := cmd.PersistentFlags()
+
+	flags.StringVar(&l.Env, "env", "", "the environment, development or production (default APP_ENV or production)")
+	flags.StringVar(&l.File, "config", "", "an optional YAML config file keyed by lower case setting names (default APP_CONFIG)")
+
+	for _, setting := range configSettings {
+		usage := fmt.Sprintf("%s (env %s)", setting.Usage, setting.Env)
+		if setting.Default != "" {
+			usage = fmt.Sprintf("%s (env %s, default %s)", setting.Usage, setting.Env, setting.Default)
+		}
+		flags.String(setting.flagName(), "", usage)
+	}
+
+	l.flags = flags
+
+	_ = cmd.ParseFlags(os.Args[1:])
+}
+
+// Load resolves, parses and validates the configuration, reporting every
+// invalid setting at once
+func (l *ConfigLoader) Load() (*AppConfig, error) {
+	resolved, err := l.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(resolved.Env, resolved.Values)
+}
+
+// resolve reads every source and picks the value of each setting
+func (l *ConfigLoader) resolve() (*resolvedConfig, error) {
+	resolved := &resolvedConfig{
+		Env:    l.Env,
+		File:   l.File,
+		Values: configValues{},
+	}
+
+	if resolved.Env == "" {
+		resolved.Env = getEnv("APP_ENV", EnvProduction)
+	}
+	if resolved.Env != EnvDevelopment && resolved.Env != EnvProduction {
+		return nil, fmt.Errorf("unknown environment %q, use %q or %q", resolved.Env, EnvDevelopment, EnvProduction)
+	}
+
+	if resolved.File == "" {
+		resolved.File = os.Getenv("APP_CONFIG")
+	}
+
+	fileValues := map[string]string{}
+	if resolved.File != "" {
+		var err error
+		if fileValues, err = readConfigFile(resolved.File); err != nil {
+			return nil, err
+		}
+	}
+
+	envFile, err := envFilePath(resolved.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	envFileValues, err := godotenv.Read(envFile)
+	switch {
+	case err == nil:
+		resolved.EnvFile = envFile
+		log.Printf("Loading %s environment from: %s", resolved.Env, envFile)
+	case errors.Is(err, fs.ErrNotExist):
+		log.Printf("[WARN] Environment file %s not found, using the environment only", envFile)
+	default:
+		return nil, fmt.Errorf("failed to read environment file %s: %w", envFile, err)
+	}
+
+	for _, setting := range configSettings {
+		value := configValue{Value: setting.Default, Source: SourceDefault}
+
+		if v, ok := fileValues[setting.fileKey()]; ok {
+			value = configValue{Value: v, Source: SourceFile}
+		}
+		if v := envFileValues[setting.Env]; v != "" {
+			value = configValue{Value: v, Source: SourceEnvFile}
+		}
+		if v := os.Getenv(setting.Env); v != "" {
+			value = configValue{Value: v, Source: SourceEnv}
+		}
+		if l.flags != nil && l.flags.Changed(setting.flagName()) {
+			v, _ := l.flags.GetString(setting.flagName())
+			value = configValue{Value: v, Source: SourceFlag}
+		}
+
+		resolved.Values[setting.Env] = value
+	}
+
+	return resolved, nil
+}
+
+// envFilePath returns the environment file of env: .env in the working
+// directory for development and .env.production next to the executable
+func envFilePath(env string) (string, error) {
+	if env == EnvDevelopment {
+		return ".env", nil
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, ".env.production"), nil
+}
+
+// readConfigFile reads a flat YAML config file keyed by lower case setting
+// names, joining lists with commas
+func readConfigFile(path string) (map[string]string, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".yaml" && ext != ".yml" {
+		return nil, fmt.Errorf("unsupported config file %s, use a .yaml or .yml file", path)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var document map[string]any
+	if err := yaml.Unmarshal(raw, &document); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	var unknown []string
+
+	for key, value := range document {
+		if !slices.ContainsFunc(configSettings, func(s configSetting) bool { return s.fileKey() == key }) {
+			unknown = append(unknown, key)
+			continue
+		}
+
+		switch v := value.(type) {
+		case nil:
+			values[key] = ""
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return nil, fmt.Errorf("unknown settings in config file %s: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return values, nil
+}
+
+// getEnv returns the environment variable value or fallback when unset
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
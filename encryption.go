@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// secretEnvelopePrefix marks values encrypted by SecretCipher, followed by
+// "<key id>:<base64 nonce and ciphertext>"
+const secretEnvelopePrefix = "enc:v1:"
+
+// ErrUnknownEncryptionKey is returned when an envelope references a key id that isn't configured
+var ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+
+// EncryptionKey is an AES-256 key identified in the envelopes it produces
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// SecretCipher encrypts secrets at rest with AES-256-GCM
+//
+// The first key encrypts, all keys decrypt, so keys can be rotated by
+// prepending a new one and re-encrypting. Without keys values are stored as
+// is, and values without an envelope are always read as plaintext so that
+// secrets saved before encryption was enabled keep working.
+type SecretCipher struct {
+	keys []EncryptionKey
+}
+
+// NewSecretCipher creates a cipher encrypting with keys[0]
+func NewSecretCipher(keys []EncryptionKey) *SecretCipher {
+	return &SecretCipher{keys: keys}
+}
+
+// Enabled reports whether new values are encrypted
+func (c *SecretCipher) Enabled() bool {
+	return len(c.keys) > 0
+}
+
+// Encrypt seals plaintext with the active key, bound to context (e.g. the owning record id)
+func (c *SecretCipher) Encrypt(plaintext string, context string) (string, error) {
+	if plaintext == "" || !c.Enabled() {
+		return plaintext, nil
+	}
+
+	key := c.keys[0]
+
+	gcm, err := newGCM(key.Key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(context))
+
+	return secretEnvelopePrefix + key.ID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt with the same context
+func (c *SecretCipher) Decrypt(value string, context string) (string, error) {
+	if !strings.HasPrefix(value, secretEnvelopePrefix) {
+		return value, nil
+	}
+
+	keyID, payload, ok := strings.Cut(strings.TrimPrefix(value, secretEnvelopePrefix), ":")
+	if !ok {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	key, ok := c.key(keyID)
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownEncryptionKey, keyID)
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+
+	gcm, err := newGCM(key.Key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(context))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value with key %q: %w", keyID, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// NeedsReencryption reports whether value isn't sealed with the active key
+func (c *SecretCipher) NeedsReencryption(value string) bool {
+	if value == "" || !c.Enabled() {
+		return false
+	}
+
+	return !strings.HasPrefix(value, secretEnvelopePrefix+c.keys[0].ID+":")
+}
+
+func (c *SecretCipher) key(id string) (EncryptionKey, bool) {
+	for _, key := range c.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+
+	return EncryptionKey{}, false
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// parseEncryptionKeys parses a comma separated "id:base64key" list of 32 byte keys
+func parseEncryptionKeys(value string) ([]EncryptionKey, error) {
+	var keys []EncryptionKey
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(item, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key %q must have the form id:base64key", item)
+		}
+
+		for _, key := range keys {
+			if key.ID == id {
+				return nil, fmt.Errorf("duplicate key id %q", id)
+			}
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64", id)
+		}
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, got %d", id, len(raw))
+		}
+
+		keys = append(keys, EncryptionKey{ID: id, Key: raw})
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+
+	b64 "encoding/base64"
+)
+
+// maxCredentialNameLength mirrors the max of the credentials "name" field
+const maxCredentialNameLength = 100
+
+// CredentialHandlers contains passkey management HTTP handlers
+type CredentialHandlers struct {
+	app  core.App
+	auth *AuthService
+}
+
+// NewCredentialHandlers creates new passkey management handlers
+func NewCredentialHandlers(app core.App, auth *AuthService) *CredentialHandlers {
+	return &CredentialHandlers{
+		app:  app,
+		auth: auth,
+	}
+}
+
+// HandleListCredentials lists the passkeys registered for a user
+func (h *CredentialHandlers) HandleListCredentials(e *core.RequestEvent) error {
+	info, err := e.RequestInfo()
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] Passkey Credentials: Failed to get request info: %v", err)
+		return e.BadRequestError("Invalid request", nil)
+	}
+
+	userId := info.Query["userId"]
+	if userId == "" {
+		userId = e.Auth.Id
+	}
+
+	userRecord, err := h.app.FindRecordById("users", userId)
+	if err != nil {
+		h.auth.GetLogger().Printf("[WARN] Passkey Credentials: User not found for ID: %s", userId)
+		return e.NotFoundError("User not found", nil)
+	}
+
+	canAccess, _ := e.App.CanAccessRecord(userRecord, info, userRecord.Collection().ViewRule)
+	if !canAccess {
+		h.auth.GetLogger().Printf("[SECURITY] Passkey Credentials: Access denied for user: %s", userId)
+		return e.ForbiddenError("Insufficient permissions to access this resource", nil)
+	}
+
+	records, err := h.app.FindAllRecords("credentials",
+		dbx.NewExp("user_id = {:user_id}", dbx.Params{"user_id": userRecord.Id}),
+	)
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] Passkey Credentials: Failed to list credentials for user: %s, error: %v", userId, err)
+		return e.InternalServerError("Failed to list credentials", nil)
+	}
+
+	result := make([]PasskeyCredentialInfo, 0, len(records))
+	for _, record := range records {
+		result = append(result, newPasskeyCredentialInfo(record))
+	}
+
+	return e.JSON(http.StatusOK, result)
+}
+
+// HandleRenameCredential updates the friendly name of a passkey
+func (h *CredentialHandlers) HandleRenameCredential(e *core.RequestEvent) error {
+	var data struct {
+		Name string `json:"name" form:"name"`
+	}
+	if err := e.BindBody(&data); err != nil {
+		h.auth.GetLogger().Printf("[WARN] Passkey Rename: Invalid request body: %v", err)
+		return e.BadRequestError("Invalid request format", nil)
+	}
+
+	name := strings.TrimSpace(data.Name)
+	if name == "" || len(name) > maxCredentialNameLength {
+		h.auth.GetLogger().Printf("[WARN] Passkey Rename: Invalid name length: %d", len(name))
+		return e.BadRequestError("name must be between 1 and 100 characters", nil)
+	}
+
+	record, err := h.findAccessibleCredential(e)
+	if err != nil {
+		return err
+	}
+
+	record.Set("name", name)
+	if err := h.app.Save(record); err != nil {
+		h.auth.GetLogger().Printf("[ERROR] Passkey Rename: Failed to save credential: %s, error: %v", record.Id, err)
+		return e.InternalServerError("Failed to rename credential", nil)
+	}
+
+	h.auth.GetLogger().Printf("[INFO] Passkey Rename: Renamed credential: %s", record.Id)
+
+	return e.JSON(http.StatusOK, newPasskeyCredentialInfo(record))
+}
+
+// HandleDeleteCredential revokes a passkey
+func (h *CredentialHandlers) HandleDeleteCredential(e *core.RequestEvent) error {
+	record, err := h.findAccessibleCredential(e)
+	if err != nil {
+		return err
+	}
+
+	if err := h.app.Delete(record); err != nil {
+		h.auth.GetLogger().Printf("[ERROR] Passkey Delete: Failed to delete credential: %s, error: %v", record.Id, err)
+		return e.InternalServerError("Failed to delete credential", nil)
+	}
+
+	h.auth.GetLogger().Printf("[INFO] Passkey Delete: Revoked credential: %s for user: %s", record.Id, record.GetString("user_id"))
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// findAccessibleCredential loads the credential from the {id} path param and
+// checks that the requester may update the credential's owner
+func (h *CredentialHandlers) findAccessibleCredential(e *core.RequestEvent) (*core.Record, error) {
+	id := e.Request.PathValue("id")
+
+	record, err := h.app.FindRecordById("credentials", id)
+	if err != nil {
+		h.auth.GetLogger().Printf("[WARN] Passkey Credentials: Credential not found: %s", id)
+		return nil, e.NotFoundError("Credential not found", nil)
+	}
+
+	info, err := e.RequestInfo()
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] Passkey Credentials: Failed to get request info: %v", err)
+		return nil, e.BadRequestError("Invalid request", nil)
+	}
+
+	userRecord, err := h.app.FindRecordById("users", record.GetString("user_id"))
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] Passkey Credentials: Owner not found for credential: %s", id)
+		return nil, e.NotFoundError("Credential not found", nil)
+	}
+
+	canAccess, _ := e.App.CanAccessRecord(userRecord, info, userRecord.Collection().UpdateRule)
+	if !canAccess {
+		h.auth.GetLogger().Printf("[SECURITY] Passkey Credentials: Access denied for credential: %s", id)
+		// don't reveal that the credential exists
+		return nil, e.NotFoundError("Credential not found", nil)
+	}
+
+	return record, nil
+}
+
+// newPasskeyCredentialInfo maps a credentials record to its API representation
+func newPasskeyCredentialInfo(record *core.Record) PasskeyCredentialInfo {
+	info := PasskeyCredentialInfo{
+		Id:             record.Id,
+		Name:           record.GetString("name"),
+		Transports:     []string{},
+		BackupEligible: record.GetBool("backup_eligible"),
+		BackupState:    record.GetBool("backup_state"),
+		CloneWarning:   record.GetBool("clone_warning"),
+		Created:        record.GetString("creation_date"),
+		LastUsed:       record.GetString("last_used_date"),
+	}
+
+	if aaguid, err := b64.StdEncoding.DecodeString(record.GetString("aaguid")); err == nil {
+		info.AAGUID = formatAAGUID(aaguid)
+	}
+
+	_ = json.Unmarshal([]byte(record.GetString("transports")), &info.Transports)
+	if info.Transports == nil {
+		info.Transports = []string{}
+	}
+
+	return info
+}
+
+// formatAAGUID renders a 16 byte AAGUID in the canonical UUID form, and
+// malformed ones as plain hex
+func formatAAGUID(aaguid []byte) string {
+	id, err := uuid.FromBytes(aaguid)
+	if err != nil {
+		return hex.EncodeToString(aaguid)
+	}
+
+	return id.String()
+}
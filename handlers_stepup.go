@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// StepUpHandlers contains the step-up authentication HTTP handlers
+type StepUpHandlers struct {
+	app  core.App
+	auth *AuthService
+}
+
+// NewStepUpHandlers creates new step-up handlers
+func NewStepUpHandlers(app core.App, auth *AuthService) *StepUpHandlers {
+	return &StepUpHandlers{
+		app:  app,
+		auth: auth,
+	}
+}
+
+// HandleStepUp refreshes the signed-in user's strong authentication with a
+// TOTP passcode or a passkey assertion (see HandleReauthStart)
+func (h *StepUpHandlers) HandleStepUp(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		h.auth.GetLogger().Printf("[SECURITY] Step-up: Non users auth record: %s", e.Auth.Id)
+		return e.ForbiddenError("Only user accounts can step up", nil)
+	}
+
+	record, err := h.app.FindRecordById("users", e.Auth.Id)
+	if err != nil {
+		h.auth.GetLogger().Printf("[WARN] Step-up: User not found for ID: %s", e.Auth.Id)
+		return e.NotFoundError("User not found", nil)
+	}
+
+	method, err := verifyIdentity(e, h.auth, record, false)
+	if err != nil {
+		return err
+	}
+
+	if err := recordStrongAuth(h.app, record.Id, requestAuthToken(e), types.NowDateTime()); err != nil {
+		h.auth.GetLogger().Printf("[ERROR] Step-up: Failed to record authentication for user: %s, error: %v", record.Id, err)
+		return e.InternalServerError("Failed to record authentication", nil)
+	}
+
+	h.auth.GetLogger().Printf("[SECURITY] Step-up: User: %s stepped up with %s", record.Id, method)
+
+	validUntil, _ := types.ParseDateTime(types.NowDateTime().Time().Add(stepUpMaxAge(h.auth.GetConfig())))
+
+	return e.JSON(http.StatusOK, StepUpResponse{
+		Method:     method,
+		ValidUntil: validUntil,
+	})
+}
@@ -1,33 +1,33 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base32"
-	"image/png"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
-	"github.com/pocketbase/pocketbase"
-	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pquerna/otp/totp"
 )
 
 // TOTPHandlers contains TOTP-related HTTP handlers
 type TOTPHandlers struct {
-	app     *pocketbase.PocketBase
+	app     core.App
 	auth    *AuthService
 }
 
 // NewTOTPHandlers creates new TOTP handlers
-func NewTOTPHandlers(app *pocketbase.PocketBase, auth *AuthService) *TOTPHandlers {
+func NewTOTPHandlers(app core.App, auth *AuthService) *TOTPHandlers {
 	return &TOTPHandlers{
 		app:  app,
 		auth: auth,
 	}
 }
 
-// HandleGetQR generates TOTP QR code
+// HandleGetQR serves the TOTP key as a QR code (PNG or SVG) or as JSON with
+// the otpauth URI and secret, negotiated via the format parameter or Accept
 func (h *TOTPHandlers) HandleGetQR(e *core.RequestEvent) error {
 	info, err := e.RequestInfo()
 	if err != nil {
@@ -57,6 +57,31 @@ func (h *TOTPHandlers) HandleGetQR(e *core.RequestEvent) error {
 		return e.BadRequestError("regenerate parameter must be true or false", nil)
 	}
 
+	// Replacing the TOTP secret needs a recent strong authentication
+	if regenerate {
+		if ok, err := checkStepUp(e, h.auth); !ok {
+			return err
+		}
+	}
+
+	format, err := negotiateQRFormat(info.Query["format"], e.Request.Header.Get("Accept"))
+	if err != nil {
+		h.auth.GetLogger().Printf("[WARN] TOTP QR: Invalid format parameter: %s", info.Query["format"])
+		return e.BadRequestError(err.Error(), nil)
+	}
+
+	size := h.auth.GetConfig().TOTPQRSize
+	if size == 0 {
+		size = defaultQRSize
+	}
+	if strSize := info.Query["size"]; strSize != "" {
+		size, err = strconv.Atoi(strSize)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			h.auth.GetLogger().Printf("[WARN] TOTP QR: Invalid size parameter: %s", strSize)
+			return e.BadRequestError(fmt.Sprintf("size must be between %d and %d", minQRSize, maxQRSize), nil)
+		}
+	}
+
 	record, err := h.app.FindRecordById("users", userId)
 	if err != nil {
 		h.auth.GetLogger().Printf("[WARN] TOTP QR: User not found for ID: %s", userId)
@@ -69,13 +94,19 @@ func (h *TOTPHandlers) HandleGetQR(e *core.RequestEvent) error {
 		return e.ForbiddenError("Insufficient permissions to access this resource", nil)
 	}
 
-	opts := totp.GenerateOpts{
-		Issuer:      h.auth.GetTOTPIssuer(),
-		AccountName: record.Email(),
+	// an existing secret keeps the parameters it was enrolled with
+	params := configTOTPParams(h.auth.GetConfig())
+	if !regenerate {
+		params = userTOTPParams(h.auth.GetConfig(), record)
 	}
+	opts := newTOTPGenerateOpts(h.auth.GetConfig().TOTPIssuer, record.Email(), params)
 
 	if !regenerate {
-		totpSecret := record.GetString("totpSecret")
+		totpSecret, err := getTOTPSecret(h.auth.GetSecretCipher(), record, totpSecretField)
+		if err != nil {
+			h.auth.GetLogger().Printf("[ERROR] TOTP QR: Failed to decrypt TOTP secret for user: %s, error: %v", userId, err)
+			return e.InternalServerError("Invalid TOTP configuration", nil)
+		}
 		if totpSecret == "" {
 			h.auth.GetLogger().Printf("[WARN] TOTP QR: No existing TOTP secret for user: %s", userId)
 			return e.BadRequestError("No TOTP configuration found. Please regenerate.", nil)
@@ -95,29 +126,241 @@ func (h *TOTPHandlers) HandleGetQR(e *core.RequestEvent) error {
 	}
 
 	if regenerate {
-		record.Set("totpSecret", key.Secret())
-		record.Set("multiFactorAuth", true)
+		// The new secret stays pending, and the current one in effect, until
+		// a code from it is confirmed via HandleTOTPConfirm
+		if err := setTOTPSecret(h.auth.GetSecretCipher(), record, totpPendingSecretField, key.Secret()); err != nil {
+			h.auth.GetLogger().Printf("[ERROR] TOTP QR: Failed to encrypt pending TOTP secret for user: %s, error: %v", userId, err)
+			return e.InternalServerError("Failed to save TOTP configuration", nil)
+		}
 
 		if err := h.app.Save(record); err != nil {
-			h.auth.GetLogger().Printf("[ERROR] TOTP QR: Failed to save TOTP secret for user: %s, error: %v", userId, err)
+			h.auth.GetLogger().Printf("[ERROR] TOTP QR: Failed to save pending TOTP secret for user: %s, error: %v", userId, err)
 			return e.InternalServerError("Failed to save TOTP configuration", nil)
 		}
-		h.auth.GetLogger().Printf("[INFO] TOTP QR: Successfully regenerated TOTP secret for user: %s", userId)
+		h.auth.GetLogger().Printf("[INFO] TOTP QR: Generated pending TOTP secret for user: %s", userId)
+	}
+
+	e.Response.Header().Add("Vary", "Accept")
+
+	switch format {
+	case QRFormatJSON:
+		return e.JSON(http.StatusOK, TOTPKeyResponse{
+			URI:         key.URL(),
+			Secret:      key.Secret(),
+			Issuer:      key.Issuer(),
+			AccountName: key.AccountName(),
+			Digits:      key.Digits().Length(),
+			Period:      key.Period(),
+			Algorithm:   key.Algorithm().String(),
+		})
+	case QRFormatSVG:
+		svg, err := renderQRSVG(key, size)
+		if err != nil {
+			h.auth.GetLogger().Printf("[ERROR] TOTP QR: Failed to generate SVG for user: %s, error: %v", userId, err)
+			return e.InternalServerError("Failed to generate QR code image", nil)
+		}
+
+		return e.Blob(http.StatusOK, "image/svg+xml", svg)
+	default:
+		img, err := renderQRPNG(key, size)
+		if err != nil {
+			h.auth.GetLogger().Printf("[ERROR] TOTP QR: Failed to generate PNG for user: %s, error: %v", userId, err)
+			return e.InternalServerError("Failed to generate QR code image", nil)
+		}
+
+		return e.Blob(http.StatusOK, "image/png", img)
+	}
+}
+
+// HandleTOTPConfirm activates a pending TOTP secret once the user proves
+// their authenticator app generates valid codes for it
+func (h *TOTPHandlers) HandleTOTPConfirm(e *core.RequestEvent) error {
+	var data struct {
+		UserId   string `json:"userId"`
+		Passcode string `json:"passcode"`
+	}
+	if err := e.BindBody(&data); err != nil {
+		h.auth.GetLogger().Printf("[WARN] TOTP Confirm: Invalid request body: %v", err)
+		return e.BadRequestError("Invalid request format", nil)
+	}
+
+	userId := data.UserId
+	if userId == "" {
+		userId = e.Auth.Id
 	}
 
-	var buf bytes.Buffer
-	img, err := key.Image(200, 200)
+	if data.Passcode == "" {
+		h.auth.GetLogger().Printf("[WARN] TOTP Confirm: Missing passcode for user: %s", userId)
+		return e.BadRequestError("passcode is required", nil)
+	}
+
+	record, err := h.findUpdatableUser(e, userId)
 	if err != nil {
-		h.auth.GetLogger().Printf("[ERROR] TOTP QR: Failed to generate QR image for user: %s, error: %v", userId, err)
-		return e.InternalServerError("Failed to generate QR code image", nil)
+		return err
 	}
 
-	if err := png.Encode(&buf, img); err != nil {
-		h.auth.GetLogger().Printf("[ERROR] TOTP QR: Failed to encode PNG for user: %s, error: %v", userId, err)
-		return e.InternalServerError("Failed to encode QR code image", nil)
+	limiter := h.auth.GetFailureLimiter()
+	failureKeys := []string{"ip:" + e.RealIP(), "user:" + userId}
+	if err := checkRateLimit(e, limiter, failureKeys...); err != nil {
+		h.auth.GetLogger().Printf("[SECURITY] TOTP Confirm: Throttled attempt for user: %s", userId)
+		return err
 	}
 
-	return e.Blob(http.StatusOK, "image/png", buf.Bytes())
+	pending, err := getTOTPSecret(h.auth.GetSecretCipher(), record, totpPendingSecretField)
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] TOTP Confirm: Failed to decrypt pending TOTP secret for user: %s, error: %v", userId, err)
+		return e.InternalServerError("Invalid TOTP configuration", nil)
+	}
+	if pending == "" {
+		h.auth.GetLogger().Printf("[WARN] TOTP Confirm: No pending TOTP secret for user: %s", userId)
+		return e.BadRequestError("No pending TOTP configuration found. Please regenerate.", nil)
+	}
+
+	params := configTOTPParams(h.auth.GetConfig())
+	usedAt, ok := matchTOTPCode(params, h.auth.GetConfig().TOTPSkew, data.Passcode, pending, time.Now())
+	if !ok {
+		h.auth.GetLogger().Printf("[SECURITY] TOTP Confirm: Invalid passcode for user: %s", userId)
+		registerFailure(e, limiter, h.auth.GetLogger(), failureKeys...)
+		return e.BadRequestError("Invalid TOTP passcode", nil)
+	}
+
+	if err := setTOTPSecret(h.auth.GetSecretCipher(), record, totpSecretField, pending); err != nil {
+		h.auth.GetLogger().Printf("[ERROR] TOTP Confirm: Failed to encrypt TOTP secret for user: %s, error: %v", userId, err)
+		return e.InternalServerError("Failed to save TOTP configuration", nil)
+	}
+	record.Set(totpPendingSecretField, "")
+	setUserTOTPParams(record, params)
+	record.Set("multiFactorAuth", true)
+	// The confirmation code counts as used
+	record.Set(totpLastUsedField, usedAt)
+
+	// Enabling TOTP issues a fresh batch of recovery codes in the same transaction
+	var recoveryCodes []string
+	err = h.app.RunInTransaction(func(txApp core.App) error {
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+
+		recoveryCodes, err = generateRecoveryCodes(txApp, userId)
+		return err
+	})
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] TOTP Confirm: Failed to save TOTP secret for user: %s, error: %v", userId, err)
+		return e.InternalServerError("Failed to save TOTP configuration", nil)
+	}
+
+	limiter.Reset("user:" + userId)
+
+	h.auth.GetLogger().Printf("[INFO] TOTP Confirm: Enabled TOTP for user: %s", userId)
+
+	return e.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: recoveryCodes})
+}
+
+// HandleRegenerateRecoveryCodes replaces the user's recovery codes with a new batch
+func (h *TOTPHandlers) HandleRegenerateRecoveryCodes(e *core.RequestEvent) error {
+	var data struct {
+		UserId string `json:"userId"`
+	}
+	if err := e.BindBody(&data); err != nil {
+		h.auth.GetLogger().Printf("[WARN] TOTP Recovery Codes: Invalid request body: %v", err)
+		return e.BadRequestError("Invalid request format", nil)
+	}
+
+	userId := data.UserId
+	if userId == "" {
+		userId = e.Auth.Id
+	}
+
+	record, err := h.findUpdatableUser(e, userId)
+	if err != nil {
+		return err
+	}
+
+	if record.GetString(totpSecretField) == "" {
+		h.auth.GetLogger().Printf("[WARN] TOTP Recovery Codes: TOTP not configured for user: %s", userId)
+		return e.BadRequestError("TOTP not configured for this account", nil)
+	}
+
+	recoveryCodes, err := generateRecoveryCodes(h.app, userId)
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] TOTP Recovery Codes: Failed to generate codes for user: %s, error: %v", userId, err)
+		return e.InternalServerError("Failed to generate recovery codes", nil)
+	}
+
+	h.auth.GetLogger().Printf("[SECURITY] TOTP Recovery Codes: Regenerated recovery codes for user: %s", userId)
+
+	return e.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: recoveryCodes})
+}
+
+// HandleTOTPDisable turns TOTP off for the signed-in user once they
+// re-authenticate, revoking their recovery codes
+func (h *TOTPHandlers) HandleTOTPDisable(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		h.auth.GetLogger().Printf("[SECURITY] TOTP Disable: Non users auth record: %s", e.Auth.Id)
+		return e.ForbiddenError("Only user accounts have TOTP", nil)
+	}
+
+	record, err := h.app.FindRecordById("users", e.Auth.Id)
+	if err != nil {
+		h.auth.GetLogger().Printf("[WARN] TOTP Disable: User not found for ID: %s", e.Auth.Id)
+		return e.NotFoundError("User not found", nil)
+	}
+
+	method, err := reauthenticate(e, h.auth, record)
+	if err != nil {
+		return err
+	}
+
+	err = h.app.RunInTransaction(func(txApp core.App) error {
+		record.Set(totpSecretField, "")
+		record.Set(totpPendingSecretField, "")
+		record.Set(totpLastUsedField, 0)
+		clearUserTOTPParams(record)
+		record.Set("multiFactorAuth", false)
+
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+
+		return deleteRecoveryCodes(txApp, record.Id)
+	})
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] TOTP Disable: Failed to disable TOTP for user: %s, error: %v", record.Id, err)
+		return e.InternalServerError("Failed to disable TOTP", nil)
+	}
+
+	h.auth.GetLogger().Printf("[SECURITY] TOTP Disable: Disabled TOTP for user: %s (confirmed with %s)", record.Id, method)
+	e.App.Logger().Warn(
+		"TOTP disabled",
+		"userId", record.Id,
+		"reauthMethod", method,
+		"ip", e.RealIP(),
+	)
+
+	return e.NoContent(http.StatusNoContent)
+}
+
+// findUpdatableUser loads the user record the request may manage TOTP settings for
+func (h *TOTPHandlers) findUpdatableUser(e *core.RequestEvent, userId string) (*core.Record, error) {
+	info, err := e.RequestInfo()
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] TOTP: Failed to get request info: %v", err)
+		return nil, e.BadRequestError("Invalid request", nil)
+	}
+
+	record, err := h.app.FindRecordById("users", userId)
+	if err != nil {
+		h.auth.GetLogger().Printf("[WARN] TOTP: User not found for ID: %s", userId)
+		return nil, e.NotFoundError("User not found", nil)
+	}
+
+	canAccess, _ := e.App.CanAccessRecord(record, info, record.Collection().UpdateRule)
+	if !canAccess {
+		h.auth.GetLogger().Printf("[SECURITY] TOTP: Access denied for user: %s", userId)
+		return nil, e.ForbiddenError("Insufficient permissions to access this resource", nil)
+	}
+
+	return record, nil
 }
 
 // HandleTOTPLogin validates TOTP passcode and logs in user
@@ -133,47 +376,115 @@ func (h *TOTPHandlers) HandleTOTPLogin(e *core.RequestEvent) error {
 		return e.BadRequestError("mfaId is required", nil)
 	}
 
-	if data.Passcode == "" {
+	if data.Passcode == "" && data.RecoveryCode == "" {
 		h.auth.GetLogger().Printf("[WARN] TOTP Login: Missing passcode for mfaId: %s", data.MfaId)
 		return e.BadRequestError("passcode is required", nil)
 	}
 
-	// Validate passcode format (6 digits)
-	if len(data.Passcode) != 6 {
-		h.auth.GetLogger().Printf("[WARN] TOTP Login: Invalid passcode length for mfaId: %s", data.MfaId)
-		return e.BadRequestError("passcode must be 6 digits", nil)
+	limiter := h.auth.GetFailureLimiter()
+	failureKeys := []string{"ip:" + e.RealIP(), "mfa:" + data.MfaId}
+	if err := checkRateLimit(e, limiter, failureKeys...); err != nil {
+		h.auth.GetLogger().Printf("[SECURITY] TOTP Login: Throttled attempt for mfaId: %s", data.MfaId)
+		return err
 	}
 
-	record, err := h.app.FindRecordById("_mfas", data.MfaId)
-	if err != nil {
-		h.auth.GetLogger().Printf("[SECURITY] TOTP Login: Invalid MFA record: %s", data.MfaId)
+	mfa, err := findPendingMFA(e, data.MfaId)
+	if errors.Is(err, errInvalidMFA) {
+		h.auth.GetLogger().Printf("[SECURITY] TOTP Login: Rejected MFA record: %s, error: %v", data.MfaId, err)
+		registerFailure(e, limiter, h.auth.GetLogger(), failureKeys...)
 		return e.UnauthorizedError("Invalid authentication request", nil)
 	}
-
-	userId := record.GetString("recordRef")
-	if userId == "" {
-		h.auth.GetLogger().Printf("[ERROR] TOTP Login: Missing recordRef in MFA record: %s", data.MfaId)
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] TOTP Login: Failed to load MFA record: %s, error: %v", data.MfaId, err)
 		return e.InternalServerError("Invalid MFA configuration", nil)
 	}
 
+	userId := mfa.RecordRef()
+
 	userRecord, err := h.app.FindRecordById("users", userId)
 	if err != nil {
 		h.auth.GetLogger().Printf("[ERROR] TOTP Login: User not found for ID: %s", userId)
 		return e.UnauthorizedError("Invalid authentication request", nil)
 	}
 
-	secret := userRecord.GetString("totpSecret")
+	failureKeys = append(failureKeys, "user:"+userId)
+	if err := checkRateLimit(e, limiter, failureKeys...); err != nil {
+		h.auth.GetLogger().Printf("[SECURITY] TOTP Login: Throttled attempt for user: %s", userId)
+		return err
+	}
+
+	if data.RecoveryCode != "" {
+		return h.recoveryCodeLogin(e, data, userRecord, failureKeys)
+	}
+
+	secret, err := getTOTPSecret(h.auth.GetSecretCipher(), userRecord, totpSecretField)
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] TOTP Login: Failed to decrypt TOTP secret for user: %s, error: %v", userId, err)
+		return e.InternalServerError("Invalid TOTP configuration", nil)
+	}
 	if secret == "" {
 		h.auth.GetLogger().Printf("[ERROR] TOTP Login: No TOTP secret configured for user: %s", userId)
 		return e.UnauthorizedError("TOTP not configured for this account", nil)
 	}
 
-	if !totp.Validate(data.Passcode, secret) {
+	// Validate passcode format against the user's enrollment
+	params := userTOTPParams(h.auth.GetConfig(), userRecord)
+	if len(data.Passcode) != params.Digits.Length() {
+		h.auth.GetLogger().Printf("[WARN] TOTP Login: Invalid passcode length for user: %s", userId)
+		return e.BadRequestError(fmt.Sprintf("passcode must be %d digits", params.Digits.Length()), nil)
+	}
+
+	usedAt, ok := matchTOTPCode(params, h.auth.GetConfig().TOTPSkew, data.Passcode, secret, time.Now())
+	if !ok {
 		h.auth.GetLogger().Printf("[SECURITY] TOTP Login: Invalid passcode attempt for user: %s", userId)
+		registerFailure(e, limiter, h.auth.GetLogger(), failureKeys...)
 		return e.UnauthorizedError("Invalid TOTP passcode", nil)
 	}
 
+	if err := consumeTOTPCode(h.app, userId, usedAt); err != nil {
+		if errors.Is(err, ErrTOTPReplay) {
+			h.auth.GetLogger().Printf("[SECURITY] TOTP Login: Replayed passcode for user: %s", userId)
+			registerFailure(e, limiter, h.auth.GetLogger(), failureKeys...)
+			return e.UnauthorizedError("Invalid TOTP passcode", nil)
+		}
+		h.auth.GetLogger().Printf("[ERROR] TOTP Login: Failed to record passcode use for user: %s, error: %v", userId, err)
+		return e.InternalServerError("Failed to verify passcode", nil)
+	}
+
+	limiter.Reset("mfa:" + data.MfaId)
+	limiter.Reset("user:" + userId)
+
 	h.auth.GetLogger().Printf("[INFO] TOTP Login: Successful authentication for user: %s", userId)
 
-	return apis.RecordAuthResponse(e, userRecord, "totp", nil)
+	return mfaAuthResponse(e, userRecord, data.MfaId, "totp")
+}
+
+// recoveryCodeLogin completes the MFA step with a single-use recovery code
+// in place of a TOTP passcode
+func (h *TOTPHandlers) recoveryCodeLogin(e *core.RequestEvent, data UserTotp, userRecord *core.Record, failureKeys []string) error {
+	limiter := h.auth.GetFailureLimiter()
+
+	remaining, err := consumeRecoveryCode(h.app, userRecord.Id, data.RecoveryCode)
+	if err != nil {
+		if errors.Is(err, ErrInvalidRecoveryCode) {
+			h.auth.GetLogger().Printf("[SECURITY] TOTP Login: Invalid recovery code attempt for user: %s", userRecord.Id)
+			registerFailure(e, limiter, h.auth.GetLogger(), failureKeys...)
+			return e.UnauthorizedError("Invalid recovery code", nil)
+		}
+		h.auth.GetLogger().Printf("[ERROR] TOTP Login: Failed to consume recovery code for user: %s, error: %v", userRecord.Id, err)
+		return e.InternalServerError("Failed to verify recovery code", nil)
+	}
+
+	limiter.Reset("mfa:" + data.MfaId)
+	limiter.Reset("user:" + userRecord.Id)
+
+	h.auth.GetLogger().Printf("[SECURITY] TOTP Login: Recovery code used for user: %s (%d remaining)", userRecord.Id, remaining)
+	e.App.Logger().Warn(
+		"TOTP recovery code used",
+		"userId", userRecord.Id,
+		"remaining", remaining,
+		"ip", e.RealIP(),
+	)
+
+	return mfaAuthResponse(e, userRecord, data.MfaId, "recoveryCode")
 }
\ No newline at end of file
@@ -1,22 +1,28 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
 	"net/http"
 	"strings"
 
-	"github.com/pocketbase/pocketbase"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/routine"
 )
 
+// passkeyAuthMethod is the auth method name passkey logins report to PocketBase
+const passkeyAuthMethod = "passkeys"
+
 // WebAuthnHandlers contains WebAuthn-related HTTP handlers
 type WebAuthnHandlers struct {
-	app  *pocketbase.PocketBase
+	app  core.App
 	auth *AuthService
 }
 
 // NewWebAuthnHandlers creates new WebAuthn handlers
-func NewWebAuthnHandlers(app *pocketbase.PocketBase, auth *AuthService) *WebAuthnHandlers {
+func NewWebAuthnHandlers(app core.App, auth *AuthService) *WebAuthnHandlers {
 	return &WebAuthnHandlers{
 		app:  app,
 		auth: auth,
@@ -24,26 +30,53 @@ func NewWebAuthnHandlers(app *pocketbase.PocketBase, auth *AuthService) *WebAuth
 }
 
 // HandleRegisterStart begins WebAuthn registration
+//
+// Signed-in users add a passkey to their own account. When the open
+// registration policy is enabled, anonymous callers may create a new account
+// by first requesting a sign-up link by email and then presenting its token.
 func (h *WebAuthnHandlers) HandleRegisterStart(e *core.RequestEvent) error {
-	email, err := getEmail(e)
-	if err != nil {
-		h.auth.GetLogger().Printf("[WARN] WebAuthn Register: Invalid email in request: %v", err)
-		return e.BadRequestError("Invalid email address", nil)
-	}
-
-	// Basic email validation
-	if len(email) < 3 || !strings.Contains(email, "@") {
-		h.auth.GetLogger().Printf("[WARN] WebAuthn Register: Invalid email format: %s", email)
-		return e.BadRequestError("Valid email address is required", nil)
-	}
-
-	user, err := h.auth.GetDatastore().GetOrCreateUser(email)
-	if err != nil {
-		h.auth.GetLogger().Printf("[ERROR] WebAuthn Register: Failed to get/create user for email: %s, error: %v", email, err)
-		return e.InternalServerError("Failed to process user account", nil)
+	var user PasskeyUser
+	var email string
+	var err error
+
+	if e.Auth != nil {
+		if e.Auth.Collection().Name != "users" {
+			h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register: Non users auth record: %s", e.Auth.Id)
+			return e.ForbiddenError("Passkeys can only be registered for user accounts", nil)
+		}
+
+		user, err = h.auth.GetDatastore().GetUser(e.Auth.Id)
+		if err != nil {
+			h.auth.GetLogger().Printf("[ERROR] WebAuthn Register: Failed to load user: %s, error: %v", e.Auth.Id, err)
+			return e.InternalServerError("Failed to process user account", nil)
+		}
+		email = e.Auth.Email()
+	} else {
+		if h.auth.GetConfig().RegistrationPolicy != RegistrationPolicyOpen {
+			h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register: Unauthenticated registration attempt")
+			return e.UnauthorizedError("Sign in to add a passkey to your account", nil)
+		}
+
+		var data struct {
+			Email string `json:"email" form:"email"`
+			Token string `json:"token" form:"token"`
+		}
+		if err := e.BindBody(&data); err != nil {
+			h.auth.GetLogger().Printf("[WARN] WebAuthn Register: Invalid request body: %v", err)
+			return e.BadRequestError("Invalid request format", nil)
+		}
+
+		if data.Token == "" {
+			return h.requestSignupLink(e, data.Email)
+		}
+
+		user, email, err = h.beginSignup(e, data.Token)
+		if err != nil {
+			return err
+		}
 	}
 
-	options, session, err := h.auth.GetWebAuthn().BeginRegistration(user)
+	options, session, err := h.auth.GetWebAuthn().BeginRegistration(user, h.auth.RegistrationOptions(user)...)
 	if err != nil {
 		h.auth.GetLogger().Printf("[ERROR] WebAuthn Register: Failed to begin registration for email: %s, error: %v", email, err)
 		return e.InternalServerError("Failed to initialize registration", nil)
@@ -60,6 +93,7 @@ func (h *WebAuthnHandlers) HandleRegisterStart(e *core.RequestEvent) error {
 	h.auth.GetDatastore().SaveSession(sessionID, LocalSession{
 		SessionData: *session,
 		Email:       email,
+		UserId:      user.RecordID(),
 	})
 
 	e.Response.Header().Set("Session-Key", sessionID)
@@ -81,11 +115,26 @@ func (h *WebAuthnHandlers) HandleRegisterFinish(e *core.RequestEvent) error {
 		return e.UnauthorizedError("Invalid or expired registration session", nil)
 	}
 
-	user, err := h.auth.GetDatastore().GetOrCreateUser(session.Email)
-	if err != nil {
-		h.auth.GetLogger().Printf("[ERROR] WebAuthn Register Finish: Failed to get user for email: %s, error: %v", session.Email, err)
+	// A signed-in caller can only finish a ceremony bound to itself
+	if e.Auth != nil && e.Auth.Id != session.UserId {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register Finish: Session user %s doesn't match auth record %s", session.UserId, e.Auth.Id)
 		h.auth.GetDatastore().DeleteSession(sessionID)
-		return e.InternalServerError("Failed to process user account", nil)
+		return e.UnauthorizedError("Invalid or expired registration session", nil)
+	}
+
+	isSignup := session.UserId == ""
+
+	var user PasskeyUser
+	if isSignup {
+		user = newPendingUser(h.app, session.Email, session.SessionData.UserID)
+	} else {
+		var err error
+		user, err = h.auth.GetDatastore().GetUser(session.UserId)
+		if err != nil {
+			h.auth.GetLogger().Printf("[ERROR] WebAuthn Register Finish: Failed to get user: %s, error: %v", session.UserId, err)
+			h.auth.GetDatastore().DeleteSession(sessionID)
+			return e.InternalServerError("Failed to process user account", nil)
+		}
 	}
 
 	var ccr CredentialCreationResponse
@@ -100,12 +149,40 @@ func (h *WebAuthnHandlers) HandleRegisterFinish(e *core.RequestEvent) error {
 		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register Finish: Failed to verify credential for email: %s, error: %v", session.Email, err)
 		h.clearSessionCookie(e, sessionID)
 		h.auth.GetDatastore().DeleteSession(sessionID)
+		if isAttestationError(err) {
+			return e.BadRequestError("The authenticator's attestation could not be verified", nil)
+		}
 		return e.BadRequestError("Failed to verify credential", nil)
 	}
 
-	if err := user.AddCredential(credential, session.Email); err != nil {
-		h.auth.GetLogger().Printf("[ERROR] WebAuthn Register Finish: Failed to save credential for email: %s, error: %v", session.Email, err)
+	if err := checkAttestationPolicy(h.auth.GetConfig(), credential); err != nil {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register Finish: Rejected authenticator for email: %s, error: %v", session.Email, err)
+		h.clearSessionCookie(e, sessionID)
 		h.auth.GetDatastore().DeleteSession(sessionID)
+		if errors.Is(err, ErrAttestationRequired) {
+			return e.ForbiddenError("This authenticator didn't provide the required attestation", nil)
+		}
+		return e.ForbiddenError("This authenticator model isn't allowed", nil)
+	}
+
+	if isSignup {
+		err = h.createSignupAccount(session.Email, session.SessionData.UserID, credential)
+	} else {
+		err = user.AddCredential(credential)
+	}
+	if err != nil {
+		h.auth.GetDatastore().DeleteSession(sessionID)
+		if errors.Is(err, ErrDuplicateCredential) {
+			h.auth.GetLogger().Printf("[WARN] WebAuthn Register Finish: Credential already registered for email: %s", session.Email)
+			h.clearSessionCookie(e, sessionID)
+			return e.Error(http.StatusConflict, "This passkey is already registered", nil)
+		}
+		if isSignup && isNotUniqueError(err, "email") {
+			h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register Finish: Sign-up completed for existing account: %s", session.Email)
+			h.clearSessionCookie(e, sessionID)
+			return e.BadRequestError("An account already exists for this email, sign in to add a passkey", nil)
+		}
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Register Finish: Failed to save credential for email: %s, error: %v", session.Email, err)
 		return e.InternalServerError("Failed to save credential", nil)
 	}
 
@@ -117,6 +194,106 @@ func (h *WebAuthnHandlers) HandleRegisterFinish(e *core.RequestEvent) error {
 	return e.JSON(http.StatusOK, "Registration Success")
 }
 
+// requestSignupLink emails a sign-up link for a brand-new account. The
+// response is the same whether or not the email is already registered.
+func (h *WebAuthnHandlers) requestSignupLink(e *core.RequestEvent, email string) error {
+	// Basic email validation
+	if len(email) < 3 || !strings.Contains(email, "@") {
+		h.auth.GetLogger().Printf("[WARN] WebAuthn Register: Invalid email format: %s", email)
+		return e.BadRequestError("Valid email address is required", nil)
+	}
+
+	collection, err := h.app.FindCachedCollectionByNameOrId("users")
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Register: Failed to find users collection: %v", err)
+		return e.InternalServerError("Failed to process user account", nil)
+	}
+
+	if _, err := h.app.FindAuthRecordByEmail(collection, email); err == nil {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register: Sign-up link requested for existing account: %s", email)
+	} else {
+		token, err := newSignupToken(collection, email)
+		if err != nil {
+			h.auth.GetLogger().Printf("[ERROR] WebAuthn Register: Failed to create sign-up token for email: %s, error: %v", email, err)
+			return e.InternalServerError("Failed to process user account", nil)
+		}
+
+		// send in the background as a basic timing enumeration protection
+		routine.FireAndForget(func() {
+			if err := sendSignupEmail(h.app, h.auth.GetConfig(), email, token); err != nil {
+				h.auth.GetLogger().Printf("[ERROR] WebAuthn Register: Failed to send sign-up email to: %s, error: %v", email, err)
+			}
+		})
+
+		h.auth.GetLogger().Printf("[INFO] WebAuthn Register: Sent sign-up link to email: %s", email)
+	}
+
+	return e.JSON(http.StatusAccepted, map[string]string{
+		"message": "If the address can be used for a new account, a sign-up link has been sent to it.",
+	})
+}
+
+// beginSignup validates a sign-up token and returns the pending user its
+// passkey is registered for. The account itself is created by
+// HandleRegisterFinish once the passkey is verified.
+func (h *WebAuthnHandlers) beginSignup(e *core.RequestEvent, token string) (PasskeyUser, string, error) {
+	collection, err := h.app.FindCachedCollectionByNameOrId("users")
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Register: Failed to find users collection: %v", err)
+		return nil, "", e.InternalServerError("Failed to process user account", nil)
+	}
+
+	email, err := parseSignupToken(collection, token)
+	if err != nil {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register: Invalid sign-up token: %v", err)
+		return nil, "", e.UnauthorizedError("Invalid or expired sign-up link", nil)
+	}
+
+	if _, err := h.app.FindAuthRecordByEmail(collection, email); err == nil {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Register: Sign-up token used for existing account: %s", email)
+		return nil, "", e.BadRequestError("An account already exists for this email, sign in to add a passkey", nil)
+	}
+
+	handle, err := newUserHandle()
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Register: Failed to create user handle for email: %s, error: %v", email, err)
+		return nil, "", e.InternalServerError("Failed to process user account", nil)
+	}
+
+	userHandle, _ := base64.RawURLEncoding.DecodeString(handle)
+
+	return newPendingUser(h.app, email, userHandle), email, nil
+}
+
+// createSignupAccount creates the verified account of a sign-up together with
+// its first passkey, so that no account exists without one
+func (h *WebAuthnHandlers) createSignupAccount(email string, userHandle []byte, credential *webauthn.Credential) error {
+	return h.app.RunInTransaction(func(txApp core.App) error {
+		user, err := h.auth.GetDatastore().CreateUser(txApp, email, userHandle)
+		if err != nil {
+			return err
+		}
+
+		// the sign-up token proved control of the mailbox
+		record, err := txApp.FindRecordById("users", user.RecordID())
+		if err != nil {
+			return err
+		}
+		record.SetVerified(true)
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+
+		if err := user.AddCredential(credential); err != nil {
+			return err
+		}
+
+		h.auth.GetLogger().Printf("[INFO] WebAuthn Register: Created account from sign-up link for email: %s", email)
+
+		return nil
+	})
+}
+
 // HandleLoginStart begins WebAuthn authentication
 func (h *WebAuthnHandlers) HandleLoginStart(e *core.RequestEvent) error {
 	email, err := getEmail(e)
@@ -131,15 +308,17 @@ func (h *WebAuthnHandlers) HandleLoginStart(e *core.RequestEvent) error {
 		return e.BadRequestError("Valid email address is required", nil)
 	}
 
-	user, err := h.auth.GetDatastore().GetOrCreateUser(email)
+	// Unknown accounts and accounts without passkeys get the same response
+	// so that the endpoint can't be used to enumerate users
+	user, err := h.auth.GetDatastore().GetUserByEmail(email)
 	if err != nil {
-		h.auth.GetLogger().Printf("[ERROR] WebAuthn Login: Failed to get user for email: %s, error: %v", email, err)
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Login: No user for email: %s, error: %v", email, err)
 		return e.UnauthorizedError("Authentication failed", nil)
 	}
 
-	options, session, err := h.auth.GetWebAuthn().BeginLogin(user)
+	options, session, err := h.auth.GetWebAuthn().BeginLogin(user, h.auth.LoginOptions()...)
 	if err != nil {
-		h.auth.GetLogger().Printf("[ERROR] WebAuthn Login: Failed to begin login for email: %s, error: %v", email, err)
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Login: Failed to begin login for email: %s, error: %v", email, err)
 		return e.UnauthorizedError("Authentication failed", nil)
 	}
 
@@ -154,6 +333,7 @@ func (h *WebAuthnHandlers) HandleLoginStart(e *core.RequestEvent) error {
 	h.auth.GetDatastore().SaveSession(sessionID, LocalSession{
 		SessionData: *session,
 		Email:       email,
+		UserId:      user.RecordID(),
 	})
 
 	e.Response.Header().Set("Login-Key", sessionID)
@@ -174,13 +354,24 @@ func (h *WebAuthnHandlers) HandleLoginFinish(e *core.RequestEvent) error {
 		return e.UnauthorizedError("Invalid or expired login session", nil)
 	}
 
-	user, err := h.auth.GetDatastore().GetOrCreateUser(session.Email)
+	user, err := h.auth.GetDatastore().GetUser(session.UserId)
 	if err != nil {
-		h.auth.GetLogger().Printf("[ERROR] WebAuthn Login Finish: Failed to get user for email: %s, error: %v", session.Email, err)
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Login Finish: No user for email: %s, error: %v", session.Email, err)
 		h.auth.GetDatastore().DeleteSession(sessionID)
 		return e.UnauthorizedError("Authentication failed", nil)
 	}
 
+	limiter := h.auth.GetFailureLimiter()
+	failureKeys := []string{"ip:" + e.RealIP(), "user:" + session.UserId}
+	if session.MfaId != "" {
+		failureKeys = append(failureKeys, "mfa:"+session.MfaId)
+	}
+	if err := checkRateLimit(e, limiter, failureKeys...); err != nil {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Login Finish: Throttled attempt for email: %s", session.Email)
+		h.auth.GetDatastore().DeleteSession(sessionID)
+		return err
+	}
+
 	var ccr CredentialCreationResponse
 	if err := e.BindBody(&ccr); err != nil {
 		h.auth.GetLogger().Printf("[WARN] WebAuthn Login Finish: Invalid credential data for email: %s, error: %v", session.Email, err)
@@ -192,27 +383,276 @@ func (h *WebAuthnHandlers) HandleLoginFinish(e *core.RequestEvent) error {
 	if err != nil {
 		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Login Finish: Failed to verify credential for email: %s, error: %v", session.Email, err)
 		h.auth.GetDatastore().DeleteSession(sessionID)
+		registerFailure(e, limiter, h.auth.GetLogger(), failureKeys...)
 		return e.UnauthorizedError("Authentication failed", nil)
 	}
 
-	// Handle credential.Authenticator.CloneWarning
-	if credential.Authenticator.CloneWarning {
-		h.auth.GetLogger().Printf("[WARN] CloneWarning detected during login")
-	}
-
-	user.UpdateCredential(credential)
+	h.auth.GetDatastore().DeleteSession(sessionID)
 
-	userRecord, err := h.app.FindFirstRecordByData("users", "email", session.Email)
+	userRecord, err := h.app.FindRecordById("users", user.RecordID())
 	if err != nil {
 		h.auth.GetLogger().Printf("[ERROR] WebAuthn Login Finish: User record not found for email: %s, error: %v", session.Email, err)
-		h.auth.GetDatastore().DeleteSession(sessionID)
 		return e.UnauthorizedError("Authentication failed", nil)
 	}
 
+	if err := h.completeLogin(e, user, credential, userRecord, session.MfaId); err != nil {
+		return err
+	}
+
+	limiter.Reset("user:" + session.UserId)
+	if session.MfaId != "" {
+		limiter.Reset("mfa:" + session.MfaId)
+	}
+
 	h.auth.GetLogger().Printf("[INFO] WebAuthn Login: Successful authentication for email: %s", session.Email)
+
+	return nil
+}
+
+// HandleDiscoverableLoginStart begins usernameless WebAuthn authentication
+func (h *WebAuthnHandlers) HandleDiscoverableLoginStart(e *core.RequestEvent) error {
+	options, session, err := h.auth.GetWebAuthn().BeginDiscoverableLogin(h.auth.LoginOptions()...)
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Discoverable Login: Failed to begin login, error: %v", err)
+		return e.UnauthorizedError("Authentication failed", nil)
+	}
+
+	sessionID, err := h.auth.GetDatastore().GenSessionID()
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Discoverable Login: Failed to generate session ID, error: %v", err)
+		return e.InternalServerError("Failed to create login session", nil)
+	}
+
+	h.auth.GetLogger().Printf("[INFO] WebAuthn Discoverable Login: Started authentication")
+
+	h.auth.GetDatastore().SaveSession(sessionID, LocalSession{
+		SessionData: *session,
+	})
+
+	e.Response.Header().Set("Login-Key", sessionID)
+	return e.JSON(http.StatusOK, options)
+}
+
+// HandleDiscoverableLoginFinish completes usernameless WebAuthn authentication,
+// resolving the user from the credential's user handle
+func (h *WebAuthnHandlers) HandleDiscoverableLoginFinish(e *core.RequestEvent) error {
+	sessionID := e.Request.Header.Get("Login-Key")
+	if sessionID == "" {
+		h.auth.GetLogger().Printf("[WARN] WebAuthn Discoverable Login Finish: Missing Login-Key header")
+		return e.BadRequestError("Login-Key header is required", nil)
+	}
+
+	session, ok := h.auth.GetDatastore().GetSession(sessionID)
+	if !ok {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Discoverable Login Finish: Invalid or expired session: %s", sessionID)
+		return e.UnauthorizedError("Invalid or expired login session", nil)
+	}
+
+	// The session is single use regardless of the outcome
 	h.auth.GetDatastore().DeleteSession(sessionID)
 
-	return apis.RecordAuthResponse(e, userRecord, "passkeys", nil)
+	var ccr CredentialCreationResponse
+	if err := e.BindBody(&ccr); err != nil {
+		h.auth.GetLogger().Printf("[WARN] WebAuthn Discoverable Login Finish: Invalid credential data, error: %v", err)
+		return e.BadRequestError("Invalid credential data", nil)
+	}
+
+	// The user is only known once the credential is resolved, so failures
+	// are throttled per client IP
+	limiter := h.auth.GetFailureLimiter()
+	ipKey := "ip:" + e.RealIP()
+	if err := checkRateLimit(e, limiter, ipKey); err != nil {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Discoverable Login Finish: Throttled attempt from ip: %s", e.RealIP())
+		return err
+	}
+
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		return h.auth.GetDatastore().GetUserByCredential(rawID, userHandle)
+	}
+
+	webauthnUser, credential, err := h.auth.GetWebAuthn().FinishPasskeyLogin(handler, session.SessionData, e.Request)
+	if err != nil {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Discoverable Login Finish: Failed to verify credential %s, error: %v", ccr.RawID, err)
+		registerFailure(e, limiter, h.auth.GetLogger(), ipKey)
+		return e.UnauthorizedError("Authentication failed", nil)
+	}
+
+	user, ok := webauthnUser.(PasskeyUser)
+	if !ok {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Discoverable Login Finish: Unexpected user type %T", webauthnUser)
+		return e.InternalServerError("Failed to process user account", nil)
+	}
+
+	userRecord, err := h.app.FindRecordById("users", user.RecordID())
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Discoverable Login Finish: User record not found for ID: %s, error: %v", user.RecordID(), err)
+		return e.UnauthorizedError("Authentication failed", nil)
+	}
+
+	if err := h.completeLogin(e, user, credential, userRecord, ""); err != nil {
+		return err
+	}
+
+	h.auth.GetLogger().Printf("[INFO] WebAuthn Discoverable Login: Successful authentication for user: %s", userRecord.Id)
+
+	return nil
+}
+
+// HandleMFALoginStart begins a passkey ceremony completing the pending MFA
+// of a user who signed in with another method (e.g. password), finished
+// through HandleLoginFinish
+func (h *WebAuthnHandlers) HandleMFALoginStart(e *core.RequestEvent) error {
+	var data struct {
+		MfaId string `json:"mfaId" form:"mfaId"`
+	}
+	if err := e.BindBody(&data); err != nil || data.MfaId == "" {
+		h.auth.GetLogger().Printf("[WARN] WebAuthn MFA Login: Missing mfaId")
+		return e.BadRequestError("mfaId is required", nil)
+	}
+
+	mfa, err := findPendingMFA(e, data.MfaId)
+	if errors.Is(err, errInvalidMFA) {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn MFA Login: Rejected MFA record: %s, error: %v", data.MfaId, err)
+		return e.UnauthorizedError("Invalid or expired MFA session", nil)
+	}
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn MFA Login: Failed to load MFA record: %s, error: %v", data.MfaId, err)
+		return e.InternalServerError("Failed to process user account", nil)
+	}
+
+	if mfa.Method() == passkeyAuthMethod {
+		return e.BadRequestError("A different authentication method is required", nil)
+	}
+
+	user, err := h.auth.GetDatastore().GetUser(mfa.RecordRef())
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn MFA Login: Failed to load user: %s, error: %v", mfa.RecordRef(), err)
+		return e.UnauthorizedError("Invalid or expired MFA session", nil)
+	}
+
+	options, session, err := h.auth.GetWebAuthn().BeginLogin(user, h.auth.LoginOptions()...)
+	if err != nil {
+		h.auth.GetLogger().Printf("[WARN] WebAuthn MFA Login: Failed to begin login for user: %s, error: %v", mfa.RecordRef(), err)
+		return e.BadRequestError("No passkey available for this account", nil)
+	}
+
+	sessionID, err := h.auth.GetDatastore().GenSessionID()
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn MFA Login: Failed to generate session ID, error: %v", err)
+		return e.InternalServerError("Failed to create login session", nil)
+	}
+
+	h.auth.GetLogger().Printf("[INFO] WebAuthn MFA Login: Started second factor for user: %s", mfa.RecordRef())
+
+	h.auth.GetDatastore().SaveSession(sessionID, LocalSession{
+		SessionData: *session,
+		Email:       user.WebAuthnName(),
+		UserId:      mfa.RecordRef(),
+		MfaId:       mfa.Id,
+	})
+
+	e.Response.Header().Set("Login-Key", sessionID)
+	return e.JSON(http.StatusOK, options)
+}
+
+// HandleReauthStart begins a passkey ceremony proving the signed-in user is
+// present, to be completed by an endpoint requiring re-authentication
+func (h *WebAuthnHandlers) HandleReauthStart(e *core.RequestEvent) error {
+	if e.Auth.Collection().Name != "users" {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Reauth: Non users auth record: %s", e.Auth.Id)
+		return e.ForbiddenError("Only user accounts can re-authenticate with a passkey", nil)
+	}
+
+	user, err := h.auth.GetDatastore().GetUser(e.Auth.Id)
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Reauth: Failed to load user: %s, error: %v", e.Auth.Id, err)
+		return e.InternalServerError("Failed to process user account", nil)
+	}
+
+	options, session, err := h.auth.GetWebAuthn().BeginLogin(user, h.auth.LoginOptions()...)
+	if err != nil {
+		h.auth.GetLogger().Printf("[WARN] WebAuthn Reauth: Failed to begin login for user: %s, error: %v", e.Auth.Id, err)
+		return e.BadRequestError("No passkey available for this account", nil)
+	}
+
+	sessionID, err := h.auth.GetDatastore().GenSessionID()
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Reauth: Failed to generate session ID for user: %s, error: %v", e.Auth.Id, err)
+		return e.InternalServerError("Failed to create re-authentication session", nil)
+	}
+
+	h.auth.GetDatastore().SaveSession(sessionID, LocalSession{
+		SessionData: *session,
+		Email:       e.Auth.Email(),
+		UserId:      e.Auth.Id,
+	})
+
+	e.Response.Header().Set(reauthKeyHeader, sessionID)
+	return e.JSON(http.StatusOK, options)
+}
+
+// completeLogin applies the clone warning policy, then stores the updated
+// credential and writes the auth response within a single transaction
+func (h *WebAuthnHandlers) completeLogin(e *core.RequestEvent, user PasskeyUser, credential *webauthn.Credential, userRecord *core.Record, mfaId string) error {
+	if credential.Authenticator.CloneWarning {
+		h.auth.GetLogger().Printf("[SECURITY] WebAuthn Login: Sign count regression (possible cloned authenticator) for user: %s, credential: %s",
+			userRecord.Id, URLEncodedBase64(credential.ID))
+
+		if h.auth.GetConfig().CloneWarningPolicy == CloneWarningPolicyBlock {
+			if err := user.FlagCloneWarning(h.app, credential.ID); err != nil {
+				h.auth.GetLogger().Printf("[ERROR] WebAuthn Login: Failed to flag cloned credential for user: %s, credential: %s, error: %v", userRecord.Id, URLEncodedBase64(credential.ID), err)
+			}
+			return e.UnauthorizedError("Authentication failed", nil)
+		}
+	}
+
+	var authErr error
+
+	err := runAuthTransaction(e, func(txApp core.App) error {
+		if err := user.UpdateCredential(txApp, credential); err != nil {
+			return err
+		}
+
+		// A passkey second factor hands its pending _mfas record over to
+		// PocketBase's MFA check, which reads the id from the query string
+		if mfaId != "" {
+			if _, err := txApp.FindMFAById(mfaId); err != nil {
+				authErr = e.UnauthorizedError("Invalid or expired MFA session", nil)
+				return nil
+			}
+
+			query := e.Request.URL.Query()
+			query.Set("mfaId", mfaId)
+			e.Request.URL.RawQuery = query.Encode()
+		}
+
+		e.Set(strongAuthKey, true)
+		authErr = apis.RecordAuthResponse(e, userRecord, passkeyAuthMethod, nil)
+
+		// the MFA challenge response was already written and its _mfas
+		// record has to survive for the second factor
+		if errors.Is(authErr, apis.ErrMFA) {
+			return nil
+		}
+		if authErr != nil {
+			return authErr
+		}
+
+		if mfaId != "" {
+			return consumeMFA(txApp, mfaId)
+		}
+
+		return nil
+	})
+	if authErr != nil {
+		return authErr
+	}
+	if err != nil {
+		h.auth.GetLogger().Printf("[ERROR] WebAuthn Login: Failed to update credential for user: %s, error: %v", userRecord.Id, err)
+		return e.InternalServerError("Failed to update credential", nil)
+	}
+
+	return nil
 }
 
 // clearSessionCookie clears the session cookie
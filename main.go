@@ -3,7 +3,9 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
+	_ "github.com/dorianlgs/pocketbase-experiments/migrations"
 	"github.com/dorianlgs/pocketbase-experiments/ui"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
@@ -11,15 +13,30 @@ import (
 )
 
 func main() {
-	// Load configuration
-	config, err := LoadConfig()
+	// Initialize PocketBase app
+	app := pocketbase.New()
+
+	// Load configuration from defaults, --config, the env file, the
+	// environment and flags
+	configLoader := NewConfigLoader()
+	configLoader.RegisterFlags(app.RootCmd)
+
+	// The config commands report configuration problems themselves and run
+	// without bootstrapping the app
+	configCmd := newConfigCommand(configLoader)
+	app.RootCmd.AddCommand(configCmd)
+	if cmd, _, err := app.RootCmd.Find(os.Args[1:]); err == nil && (cmd == configCmd || cmd.Parent() == configCmd) {
+		if err := app.RootCmd.Execute(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	config, err := configLoader.Load()
 	if err != nil {
 		log.Fatal("Failed to load config:", err)
 	}
 
-	// Initialize PocketBase app
-	app := pocketbase.New()
-
 	// Add indexFallback flag for SPA routing
 	var indexFallback bool
 	app.RootCmd.PersistentFlags().BoolVar(
@@ -36,11 +53,42 @@ func main() {
 		log.Fatal("Failed to initialize auth service:", err)
 	}
 
+	if !authService.GetSecretCipher().Enabled() {
+		logger.Printf("[WARN] TOTP_ENCRYPTION_KEYS is not set, TOTP secrets are stored unencrypted")
+	}
+
+	if config.MetadataFile == "" && len(config.AAGUIDAllowList)+len(config.AAGUIDDenyList) > 0 {
+		logger.Printf("[WARN] AAGUID lists without WEBAUTHN_MDS_FILE rely on unverified, client supplied AAGUIDs")
+	}
+
+	app.RootCmd.AddCommand(newTOTPReencryptCommand(app, authService.GetSecretCipher()))
+
+	// Give every new user a WebAuthn user handle
+	app.OnRecordCreate("users").BindFunc(assignUserHandle)
+
+	// Bind pending MFAs to the client that passed the first factor
+	app.OnRecordAuthRequest("users").BindFunc(bindMFAClient)
+
+	// Track step-up freshness per issued auth token
+	app.OnRecordAuthRequest("users").BindFunc(bindStrongAuthToken)
+
 	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
 		// Initialize datastore
-		datastore := NewInMem(logger, app)
+		datastore, err := NewDatastore(config, logger, app)
+		if err != nil {
+			return err
+		}
 		authService.SetDatastore(datastore)
 
+		// Periodically purge abandoned ceremony sessions
+		if sweeper, ok := datastore.(SessionSweeper); ok {
+			stopSweeper := StartSessionSweeper(sweeper, config.SessionSweepInterval, logger)
+			app.OnTerminate().BindFunc(func(te *core.TerminateEvent) error {
+				stopSweeper()
+				return te.Next()
+			})
+		}
+
 		// Setup static file serving
 		if !se.Router.HasRoute(http.MethodGet, "/{path...}") {
 			se.Router.GET("/{path...}", apis.Static(ui.DistDirFS, indexFallback)).
@@ -64,14 +112,39 @@ func setupRoutes(se *core.ServeEvent, app *pocketbase.PocketBase, authService *A
 	// Initialize handlers
 	totpHandlers := NewTOTPHandlers(app, authService)
 	webauthnHandlers := NewWebAuthnHandlers(app, authService)
+	credentialHandlers := NewCredentialHandlers(app, authService)
+	stepUpHandlers := NewStepUpHandlers(app, authService)
+
+	// Every API route is throttled per client IP
+	api := se.Router.Group("/api/pb-experiments")
+	api.BindFunc(RateLimitRequests(authService.GetRequestLimiter(), authService.GetLogger()))
 
 	// TOTP routes
-	se.Router.GET("/api/pb-experiments/get-qr", totpHandlers.HandleGetQR).Bind(apis.RequireAuth())
-	se.Router.POST("/api/pb-experiments/totp-login", totpHandlers.HandleTOTPLogin)
+	api.GET("/get-qr", totpHandlers.HandleGetQR).Bind(apis.RequireAuth())
+	api.POST("/totp-confirm", totpHandlers.HandleTOTPConfirm).Bind(apis.RequireAuth())
+	api.POST("/totp-login", totpHandlers.HandleTOTPLogin)
+	api.POST("/totp-recovery-codes", totpHandlers.HandleRegenerateRecoveryCodes).Bind(apis.RequireAuth()).BindFunc(RequireStepUp(authService))
+	api.POST("/totp-disable", totpHandlers.HandleTOTPDisable).Bind(apis.RequireAuth())
+
+	// Step-up (sudo mode) for sensitive operations
+	api.POST("/step-up", stepUpHandlers.HandleStepUp).Bind(apis.RequireAuth())
 
 	// WebAuthn routes
-	se.Router.POST("/api/pb-experiments/passkey/registerStart", webauthnHandlers.HandleRegisterStart)
-	se.Router.POST("/api/pb-experiments/passkey/registerFinish", webauthnHandlers.HandleRegisterFinish)
-	se.Router.POST("/api/pb-experiments/passkey/loginStart", webauthnHandlers.HandleLoginStart)
-	se.Router.POST("/api/pb-experiments/passkey/loginFinish", webauthnHandlers.HandleLoginFinish)
+	api.POST("/passkey/registerStart", webauthnHandlers.HandleRegisterStart).BindFunc(RequireStepUp(authService))
+	api.POST("/passkey/registerFinish", webauthnHandlers.HandleRegisterFinish)
+	api.POST("/passkey/loginStart", webauthnHandlers.HandleLoginStart)
+	api.POST("/passkey/loginFinish", webauthnHandlers.HandleLoginFinish)
+	api.POST("/passkey/discoverableLoginStart", webauthnHandlers.HandleDiscoverableLoginStart)
+	api.POST("/passkey/discoverableLoginFinish", webauthnHandlers.HandleDiscoverableLoginFinish)
+	api.POST("/passkey/mfaStart", webauthnHandlers.HandleMFALoginStart)
+	api.POST("/passkey/reauthStart", webauthnHandlers.HandleReauthStart).Bind(apis.RequireAuth())
+
+	// Related origins document of the RP ID, outside of the API prefix
+	se.Router.GET("/.well-known/webauthn", webauthnHandlers.HandleRelatedOrigins).
+		BindFunc(RateLimitRequests(authService.GetRequestLimiter(), authService.GetLogger()))
+
+	// Passkey management routes
+	api.GET("/passkey/credentials", credentialHandlers.HandleListCredentials).Bind(apis.RequireAuth())
+	api.PATCH("/passkey/credentials/{id}", credentialHandlers.HandleRenameCredential).Bind(apis.RequireAuth())
+	api.DELETE("/passkey/credentials/{id}", credentialHandlers.HandleDeleteCredential).Bind(apis.RequireAuth())
 }
\ No newline at end of file
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// mfaClientField stores the fingerprint of the client that passed the first
+// factor on its pending _mfas record
+const mfaClientField = "clientHash"
+
+// errInvalidMFA is returned for unknown, expired, foreign or differently
+// bound _mfas records
+var errInvalidMFA = errors.New("invalid or expired mfa")
+
+// mfaClientHash fingerprints the requesting client by IP and user agent
+func mfaClientHash(e *core.RequestEvent) string {
+	sum := sha256.Sum256([]byte(e.RealIP() + "\x00" + e.Request.UserAgent()))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// bindMFAClient is an OnRecordAuthRequest hook recording the client on the
+// _mfas record PocketBase creates when a first factor requires MFA
+//
+// PocketBase only reports the new record through the written response, so
+// the newest unbound record of the auth method is taken.
+func bindMFAClient(e *core.RecordAuthRequestEvent) error {
+	err := e.Next()
+	if !errors.Is(err, apis.ErrMFA) {
+		return err
+	}
+
+	mfas, findErr := e.App.FindAllMFAsByRecord(e.Record)
+	if findErr != nil {
+		return findErr
+	}
+
+	for _, mfa := range mfas {
+		if mfa.Method() != e.AuthMethod || mfa.GetString(mfaClientField) != "" {
+			continue
+		}
+
+		mfa.Set(mfaClientField, mfaClientHash(e.RequestEvent))
+		if saveErr := e.App.Save(mfa); saveErr != nil {
+			return saveErr
+		}
+
+		break
+	}
+
+	return err
+}
+
+// findPendingMFA loads a _mfas record of the users collection that hasn't
+// expired and was started by the requesting client
+//
+// Expired records are deleted on the way.
+func findPendingMFA(e *core.RequestEvent, mfaId string) (*core.MFA, error) {
+	mfa, err := e.App.FindMFAById(mfaId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not found", errInvalidMFA)
+	}
+
+	users, err := e.App.FindCachedCollectionByNameOrId("users")
+	if err != nil {
+		return nil, err
+	}
+
+	if mfa.CollectionRef() != users.Id {
+		return nil, fmt.Errorf("%w: collection mismatch", errInvalidMFA)
+	}
+
+	if mfa.HasExpired(users.MFA.DurationTime()) {
+		if err := e.App.Delete(mfa); err != nil {
+			e.App.Logger().Warn("Failed to delete expired MFA record", "error", err, "mfaId", mfa.Id)
+		}
+		return nil, fmt.Errorf("%w: expired", errInvalidMFA)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(mfa.GetString(mfaClientField)), []byte(mfaClientHash(e))) != 1 {
+		return nil, fmt.Errorf("%w: client mismatch", errInvalidMFA)
+	}
+
+	return mfa, nil
+}
+
+// runAuthTransaction runs fn in a transaction with e.App swapped for the
+// transactional app
+//
+// Anything fn writes to the response, including the auth token, is held back
+// and only sent once the transaction has committed.
+func runAuthTransaction(e *core.RequestEvent, fn func(txApp core.App) error) error {
+	response := e.Response
+	buffer := newBufferedResponse(response.Header())
+
+	e.Response = buffer
+	defer func() { e.Response = response }()
+
+	err := e.App.RunInTransaction(func(txApp core.App) error {
+		app := e.App
+		e.App = txApp
+		defer func() { e.App = app }()
+
+		return fn(txApp)
+	})
+
+	e.Response = response
+	if err != nil {
+		return err
+	}
+
+	return buffer.flushTo(response)
+}
+
+// mfaAuthResponse writes the auth response of a completed second factor,
+// marked as strong authentication for bindStrongAuthToken, and consumes the
+// pending MFA in the same transaction
+//
+// The record is re-read inside the transaction so that concurrent
+// completions of one MFA can't both succeed.
+func mfaAuthResponse(e *core.RequestEvent, userRecord *core.Record, mfaId string, authMethod string) error {
+	var authErr error
+
+	err := runAuthTransaction(e, func(txApp core.App) error {
+		if _, err := txApp.FindMFAById(mfaId); err != nil {
+			authErr = e.UnauthorizedError("Invalid or expired MFA session", nil)
+			return nil
+		}
+
+		e.Set(strongAuthKey, true)
+		authErr = apis.RecordAuthResponse(e, userRecord, authMethod, nil)
+		if authErr != nil {
+			return authErr
+		}
+
+		return consumeMFA(txApp, mfaId)
+	})
+	if authErr != nil {
+		return authErr
+	}
+	if err != nil {
+		return e.InternalServerError("Failed to complete MFA", err)
+	}
+
+	return nil
+}
+
+// consumeMFA deletes a completed MFA unless PocketBase's own check already did
+func consumeMFA(txApp core.App, mfaId string) error {
+	mfa, err := txApp.FindMFAById(mfaId)
+	if err != nil {
+		return nil
+	}
+
+	return txApp.Delete(mfa)
+}
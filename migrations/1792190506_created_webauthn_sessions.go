@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		collection := core.NewBaseCollection("_webauthnSessions")
+		collection.System = true
+
+		collection.Fields.Add(
+			&core.TextField{
+				Name:     "sessionId",
+				Required: true,
+				System:   true,
+			},
+			&core.TextField{
+				Name:   "email",
+				System: true,
+			},
+			&core.JSONField{
+				Name:   "data",
+				System: true,
+			},
+			&core.DateField{
+				Name:     "expires",
+				Required: true,
+				System:   true,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+				System:   true,
+			},
+		)
+
+		collection.AddIndex("idx_webauthnSessions_sessionId", true, "sessionId", "")
+		collection.AddIndex("idx_webauthnSessions_expires", false, "expires", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		// system collections can't be deleted through app.Delete
+		_, err := app.DB().Delete("_collections", dbx.HashExp{"name": "_webauthnSessions"}).Execute()
+		if err != nil {
+			return err
+		}
+
+		if err := app.DeleteTable("_webauthnSessions"); err != nil {
+			return err
+		}
+
+		return app.ReloadCachedCollections()
+	})
+}
@@ -0,0 +1,81 @@
+package migrations
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		if users.Fields.GetByName("webauthnUserHandle") == nil {
+			users.Fields.Add(&core.TextField{
+				Name:   "webauthnUserHandle",
+				Hidden: true,
+				Max:    128,
+			})
+			users.AddIndex("idx_webauthnUserHandle__pb_users_auth_", true, "`webauthnUserHandle`", "`webauthnUserHandle` != ''")
+
+			if err := app.Save(users); err != nil {
+				return err
+			}
+		}
+
+		// Passkeys registered before this migration carry the email as their
+		// user handle, so those users keep it (now decoupled from the email
+		// field) to avoid invalidating credentials already on authenticators.
+		legacy := map[string]bool{}
+		if _, err := app.FindCollectionByNameOrId("credentials"); err == nil {
+			var owners []string
+			err := app.DB().Select("user_id").Distinct(true).From("credentials").Column(&owners)
+			if err != nil {
+				return err
+			}
+			for _, id := range owners {
+				legacy[id] = true
+			}
+		}
+
+		records, err := app.FindAllRecords(users, dbx.NewExp("[[webauthnUserHandle]] = ''"))
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			var handle []byte
+			if legacy[record.Id] {
+				handle = []byte(record.Email())
+			} else {
+				handle = make([]byte, 32)
+				if _, err := rand.Read(handle); err != nil {
+					return err
+				}
+			}
+
+			record.Set("webauthnUserHandle", base64.RawURLEncoding.EncodeToString(handle))
+			if err := app.SaveNoValidate(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.RemoveIndex("idx_webauthnUserHandle__pb_users_auth_")
+		users.Fields.RemoveByName("webauthnUserHandle")
+
+		return app.Save(users)
+	})
+}
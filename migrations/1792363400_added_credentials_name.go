@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		credentials, err := app.FindCollectionByNameOrId("credentials")
+		if err != nil {
+			// the collection is created by importing pb_schema.json,
+			// which already includes the field
+			return nil
+		}
+
+		if credentials.Fields.GetByName("name") != nil {
+			return nil
+		}
+
+		credentials.Fields.Add(&core.TextField{
+			Name: "name",
+			Max:  100,
+		})
+
+		return app.Save(credentials)
+	}, func(app core.App) error {
+		credentials, err := app.FindCollectionByNameOrId("credentials")
+		if err != nil {
+			return nil
+		}
+
+		credentials.Fields.RemoveByName("name")
+
+		return app.Save(credentials)
+	})
+}
@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		credentials, err := app.FindCollectionByNameOrId("credentials")
+		if err != nil {
+			// the collection is created by importing pb_schema.json,
+			// which already includes the field
+			return nil
+		}
+
+		if credentials.Fields.GetByName("clone_warning") != nil {
+			return nil
+		}
+
+		credentials.Fields.Add(&core.BoolField{
+			Name: "clone_warning",
+		})
+
+		return app.Save(credentials)
+	}, func(app core.App) error {
+		credentials, err := app.FindCollectionByNameOrId("credentials")
+		if err != nil {
+			return nil
+		}
+
+		credentials.Fields.RemoveByName("clone_warning")
+
+		return app.Save(credentials)
+	})
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("_webauthnSessions")
+		if err != nil {
+			return err
+		}
+
+		// not a system field so that the down migration can remove it
+		collection.Fields.Add(&core.TextField{
+			Name: "userId",
+		})
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("_webauthnSessions")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.RemoveByName("userId")
+
+		return app.Save(collection)
+	})
+}
@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		if users.Fields.GetByName("totpLastStep") != nil {
+			return nil
+		}
+
+		users.Fields.Add(&core.NumberField{
+			Name:    "totpLastStep",
+			Hidden:  true,
+			OnlyInt: true,
+		})
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("totpLastStep")
+
+		return app.Save(users)
+	})
+}
@@ -0,0 +1,61 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("_totpRecoveryCodes")
+		collection.System = true
+
+		collection.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				CascadeDelete: true,
+				MaxSelect:     1,
+				Required:      true,
+				System:        true,
+			},
+			&core.TextField{
+				Name:     "codeHash",
+				Required: true,
+				Hidden:   true,
+				System:   true,
+			},
+			&core.DateField{
+				Name:   "used",
+				System: true,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+				System:   true,
+			},
+		)
+
+		collection.AddIndex("idx_totpRecoveryCodes_user_codeHash", true, "user, codeHash", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		// system collections can't be deleted through app.Delete
+		_, err := app.DB().Delete("_collections", dbx.HashExp{"name": "_totpRecoveryCodes"}).Execute()
+		if err != nil {
+			return err
+		}
+
+		if err := app.DeleteTable("_totpRecoveryCodes"); err != nil {
+			return err
+		}
+
+		return app.ReloadCachedCollections()
+	})
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		mfas, err := app.FindCollectionByNameOrId(core.CollectionNameMFAs)
+		if err != nil {
+			return err
+		}
+
+		if mfas.Fields.GetByName("clientHash") != nil {
+			return nil
+		}
+
+		mfas.Fields.Add(&core.TextField{
+			Name:   "clientHash",
+			Hidden: true,
+		})
+
+		return app.Save(mfas)
+	}, func(app core.App) error {
+		mfas, err := app.FindCollectionByNameOrId(core.CollectionNameMFAs)
+		if err != nil {
+			return err
+		}
+
+		mfas.Fields.RemoveByName("clientHash")
+
+		return app.Save(mfas)
+	})
+}
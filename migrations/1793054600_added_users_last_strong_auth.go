@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		if users.Fields.GetByName("lastStrongAuth") != nil {
+			return nil
+		}
+
+		users.Fields.Add(&core.DateField{
+			Name:   "lastStrongAuth",
+			Hidden: true,
+		})
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("lastStrongAuth")
+
+		return app.Save(users)
+	})
+}
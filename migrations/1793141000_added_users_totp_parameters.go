@@ -0,0 +1,111 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		if users.Fields.GetByName("totpLastUsed") != nil {
+			return nil
+		}
+
+		// Secrets enrolled before this migration have no stored parameters
+		// and keep being validated with the configured ones
+		users.Fields.Add(
+			&core.NumberField{
+				Name:    "totpDigits",
+				Hidden:  true,
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "totpPeriod",
+				Hidden:  true,
+				OnlyInt: true,
+			},
+			&core.TextField{
+				Name:   "totpAlgorithm",
+				Hidden: true,
+				Max:    16,
+			},
+			&core.NumberField{
+				Name:    "totpLastUsed",
+				Hidden:  true,
+				OnlyInt: true,
+			},
+		)
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		// The period the stored time-steps were counted in isn't known here,
+		// so codes up to now are treated as used
+		if users.Fields.GetByName("totpLastStep") != nil {
+			records, err := app.FindAllRecords(users, dbx.NewExp("[[totpLastStep]] > 0"))
+			if err != nil {
+				return err
+			}
+
+			now := time.Now().Unix()
+			for _, record := range records {
+				record.Set("totpLastUsed", now)
+				if err := app.SaveNoValidate(record); err != nil {
+					return err
+				}
+			}
+
+			users.Fields.RemoveByName("totpLastStep")
+		}
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.Add(&core.NumberField{
+			Name:    "totpLastStep",
+			Hidden:  true,
+			OnlyInt: true,
+		})
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		records, err := app.FindAllRecords(users, dbx.NewExp("[[totpLastUsed]] > 0"))
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			period := record.GetInt("totpPeriod")
+			if period <= 0 {
+				period = 30
+			}
+
+			record.Set("totpLastStep", record.GetInt("totpLastUsed")/period)
+			if err := app.SaveNoValidate(record); err != nil {
+				return err
+			}
+		}
+
+		users.Fields.RemoveByName("totpDigits")
+		users.Fields.RemoveByName("totpPeriod")
+		users.Fields.RemoveByName("totpAlgorithm")
+		users.Fields.RemoveByName("totpLastUsed")
+
+		return app.Save(users)
+	})
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// multiFactorAuth is managed by the TOTP enrollment and disable
+		// endpoints, which require a confirmed code or re-authentication
+		users.UpdateRule = types.Pointer("id = @request.auth.id && @request.body.multiFactorAuth:isset = false")
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.UpdateRule = types.Pointer("id = @request.auth.id")
+
+		return app.Save(users)
+	})
+}
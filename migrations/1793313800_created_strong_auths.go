@@ -0,0 +1,84 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("_strongAuths")
+		collection.System = true
+
+		collection.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				CascadeDelete: true,
+				MaxSelect:     1,
+				Required:      true,
+				System:        true,
+			},
+			&core.TextField{
+				Name:     "tokenHash",
+				Required: true,
+				Hidden:   true,
+				System:   true,
+			},
+			&core.DateField{
+				Name:     "authenticated",
+				Required: true,
+				System:   true,
+			},
+		)
+
+		collection.AddIndex("idx_strongAuths_tokenHash", true, "tokenHash", "")
+		collection.AddIndex("idx_strongAuths_user", false, "user", "")
+
+		if err := app.Save(collection); err != nil {
+			return err
+		}
+
+		// Strong authentications are tracked per auth token from now on,
+		// existing sessions step up again
+		if users.Fields.GetByName("lastStrongAuth") == nil {
+			return nil
+		}
+
+		users.Fields.RemoveByName("lastStrongAuth")
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.Add(&core.DateField{
+			Name:   "lastStrongAuth",
+			Hidden: true,
+		})
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		// system collections can't be deleted through app.Delete
+		_, err = app.DB().Delete("_collections", dbx.HashExp{"name": "_strongAuths"}).Execute()
+		if err != nil {
+			return err
+		}
+
+		if err := app.DeleteTable("_strongAuths"); err != nil {
+			return err
+		}
+
+		return app.ReloadCachedCollections()
+	})
+}
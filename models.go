@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"time"
 
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/pocketbase/dbx"
-	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
 
 	b64 "encoding/base64"
@@ -16,8 +20,111 @@ type User struct {
 	ID          []byte
 	DisplayName string
 	Name        string
+	Icon        string
+	recordId    string
 	creds       []webauthn.Credential
-	app         *pocketbase.PocketBase
+	app         core.App
+}
+
+// ErrDuplicateCredential is returned by AddCredential for a credential id
+// that is already registered
+var ErrDuplicateCredential = errors.New("credential already registered")
+
+// userHandleField is the users field holding the opaque WebAuthn user handle
+const userHandleField = "webauthnUserHandle"
+
+// newUser builds a WebAuthn user from a users record
+func newUser(app core.App, userRecord *core.Record) (*User, error) {
+	handle, err := userHandle(userRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	// name is the account identifier, displayName the friendly name shown
+	// next to it by the authenticator
+	displayName := userRecord.GetString("name")
+	if displayName == "" {
+		displayName = userRecord.Email()
+	}
+
+	return &User{
+		ID:          handle,
+		DisplayName: displayName,
+		Name:        userRecord.Email(),
+		Icon:        avatarURL(app, userRecord),
+		recordId:    userRecord.Id,
+		app:         app,
+	}, nil
+}
+
+// newPendingUser builds the WebAuthn user of a sign-up, whose users record is
+// only created once its first passkey is registered
+func newPendingUser(app core.App, email string, handle []byte) *User {
+	return &User{
+		ID:          handle,
+		DisplayName: email,
+		Name:        email,
+		app:         app,
+	}
+}
+
+// avatarURL returns the public file URL of the users record avatar, or an
+// empty string when it has none or the application URL isn't configured
+//
+// PocketBase only provides a file URL helper in its client SDKs
+// (pb.files.getURL), so this builds the same /api/files route.
+func avatarURL(app core.App, userRecord *core.Record) string {
+	avatar := userRecord.GetString("avatar")
+	appURL := app.Settings().Meta.AppURL
+	if avatar == "" || appURL == "" {
+		return ""
+	}
+
+	fileURL, err := url.JoinPath(appURL, "api", "files", userRecord.Collection().Id, userRecord.Id, avatar)
+	if err != nil {
+		return ""
+	}
+
+	return fileURL
+}
+
+// newUserHandle returns a random base64url encoded WebAuthn user handle
+func newUserHandle() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return b64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// userHandle returns the decoded user handle of userRecord
+func userHandle(userRecord *core.Record) ([]byte, error) {
+	encoded := userRecord.GetString(userHandleField)
+	if encoded == "" {
+		return nil, fmt.Errorf("user %s has no user handle", userRecord.Id)
+	}
+
+	return b64.RawURLEncoding.DecodeString(encoded)
+}
+
+// assignUserHandle gives users records created outside of the passkey flow a
+// user handle, existing records being backfilled by a migration
+func assignUserHandle(e *core.RecordEvent) error {
+	if e.Record.GetString(userHandleField) == "" {
+		handle, err := newUserHandle()
+		if err != nil {
+			return err
+		}
+		e.Record.Set(userHandleField, handle)
+	}
+
+	return e.Next()
+}
+
+// RecordID returns the id of the backing users record
+func (o *User) RecordID() string {
+	return o.recordId
 }
 
 func (o *User) WebAuthnID() []byte {
@@ -32,22 +139,16 @@ func (o *User) WebAuthnDisplayName() string {
 	return o.DisplayName
 }
 
+// WebAuthnIcon returns the avatar URL of the user. Current WebAuthn levels
+// dropped the icon member, so it isn't part of the ceremony options.
 func (o *User) WebAuthnIcon() string {
-	return "https://pics.com/avatar.png"
+	return o.Icon
 }
 
 func (o *User) WebAuthnCredentials() []webauthn.Credential {
 
-	userRecord, err := o.app.FindFirstRecordByData("users", "email", string(o.ID))
-
-	if err != nil {
-		return nil
-	}
-
-	userId := userRecord.GetString("id")
-
 	records, err := o.app.FindAllRecords("credentials",
-		dbx.NewExp("user_id = {:user_id}", dbx.Params{"user_id": userId}),
+		dbx.NewExp("user_id = {:user_id}", dbx.Params{"user_id": o.recordId}),
 	)
 
 	if err != nil {
@@ -63,6 +164,11 @@ func (o *User) WebAuthnCredentials() []webauthn.Credential {
 		if err != nil {
 			return nil
 		}
+		// a credential flagged by a rejected login keeps its warning, so the
+		// clone warning policy applies to every later ceremony as well
+		if record.GetBool("clone_warning") {
+			result.Authenticator.CloneWarning = true
+		}
 		credentials = append(credentials, result)
 	}
 
@@ -70,7 +176,7 @@ func (o *User) WebAuthnCredentials() []webauthn.Credential {
 
 }
 
-func (o *User) AddCredential(credential *webauthn.Credential, email string) error {
+func (o *User) AddCredential(credential *webauthn.Credential) error {
 
 	collection, err := o.app.FindCollectionByNameOrId("credentials")
 	if err != nil {
@@ -84,13 +190,6 @@ func (o *User) AddCredential(credential *webauthn.Credential, email string) erro
 		return err
 	}
 
-	userRecord, err := o.app.FindFirstRecordByData("users", "email", email)
-	if err != nil {
-		return err
-	}
-
-	//	fmt.Printf("signature_count: %s", string(o.ID))
-
 	json_credential, err := json.Marshal(credential)
 	if err != nil {
 		return err
@@ -100,7 +199,7 @@ func (o *User) AddCredential(credential *webauthn.Credential, email string) erro
 	public_key := b64.StdEncoding.EncodeToString(credential.PublicKey)
 	aaguid := b64.StdEncoding.EncodeToString(credential.Authenticator.AAGUID)
 
-	record.Set("user_id", string(userRecord.GetString("id")))
+	record.Set("user_id", o.recordId)
 	record.Set("credential_id", credential_id)
 	record.Set("public_key", public_key)
 	record.Set("attestation_type", string(credential.AttestationType))
@@ -115,6 +214,10 @@ func (o *User) AddCredential(credential *webauthn.Credential, email string) erro
 
 	err = o.app.Save(record)
 	if err != nil {
+		// the unique index on credential_id also catches concurrent registrations
+		if isNotUniqueError(err, "credential_id") {
+			return fmt.Errorf("%w: %s", ErrDuplicateCredential, credential_id)
+		}
 		return err
 	}
 
@@ -122,9 +225,25 @@ func (o *User) AddCredential(credential *webauthn.Credential, email string) erro
 
 }
 
-func (o *User) UpdateCredential(credential *webauthn.Credential) error {
+// isNotUniqueError reports whether err is PocketBase's unique index
+// validation error for field
+func isNotUniqueError(err error, field string) bool {
+	var validationErrs validation.Errors
+	if !errors.As(err, &validationErrs) {
+		return false
+	}
+
+	fieldErr, ok := validationErrs[field].(validation.Error)
+
+	return ok && fieldErr.Code() == "validation_not_unique"
+}
+
+// UpdateCredential stores the post-login state (sign count, flags, last use)
+// of one of the user's credentials. txApp allows running the update inside
+// the caller's transaction.
+func (o *User) UpdateCredential(txApp core.App, credential *webauthn.Credential) error {
 
-	record, err := o.app.FindRecordById("credentials", string(credential.ID))
+	record, err := o.findCredentialRecord(txApp, credential.ID)
 	if err != nil {
 		return err
 	}
@@ -152,11 +271,46 @@ func (o *User) UpdateCredential(credential *webauthn.Credential) error {
 	record.Set("backup_eligible", credential.Flags.BackupEligible)
 	record.Set("backup_state", credential.Flags.BackupState)
 	record.Set("json_credential", json_credential)
+	// sticky: once a sign count regression was seen the credential stays flagged
+	if credential.Authenticator.CloneWarning {
+		record.Set("clone_warning", true)
+	}
 
-	err = o.app.Save(record)
+	err = txApp.Save(record)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// FlagCloneWarning marks one of the user's credentials as possibly cloned
+// without storing the rest of the login state, for logins rejected because
+// of a sign count regression
+func (o *User) FlagCloneWarning(app core.App, credentialID []byte) error {
+	record, err := o.findCredentialRecord(app, credentialID)
+	if err != nil {
+		return err
+	}
+
+	record.Set("clone_warning", true)
+
+	return app.Save(record)
+}
+
+// findCredentialRecord returns the credentials record of one of the user's
+// credentials
+func (o *User) findCredentialRecord(app core.App, credentialID []byte) (*core.Record, error) {
+	record, err := app.FindFirstRecordByFilter("credentials",
+		"credential_id = {:credential_id} && user_id = {:user_id}",
+		dbx.Params{
+			"credential_id": b64.StdEncoding.EncodeToString(credentialID),
+			"user_id":       o.recordId,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("credential not found: %w", err)
+	}
+
+	return record, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"golang.org/x/net/publicsuffix"
+)
+
+// androidOriginPrefix starts the origin of an Android app, followed by the
+// unpadded base64url SHA-256 hash of its APK signing certificate
+const androidOriginPrefix = "android:apk-key-hash:"
+
+// RelatedOrigins is the WebAuthn related origins document served at
+// /.well-known/webauthn
+type RelatedOrigins struct {
+	Origins []string `json:"origins"`
+}
+
+// RPOrigins returns every origin WebAuthn ceremonies are accepted from,
+// starting with Origin
+func (c *AppConfig) RPOrigins() []string {
+	if len(c.Origins) == 0 {
+		return []string{c.Origin}
+	}
+
+	return c.Origins
+}
+
+// parseOrigins parses a comma separated list of web and Android app origins,
+// normalizing web origins to scheme://host[:port]
+func parseOrigins(value string) ([]string, error) {
+	var origins []string
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		origin, err := parseOrigin(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+
+	return origins, nil
+}
+
+// parseOrigin validates a single web or Android app origin
+func parseOrigin(value string) (string, error) {
+	if hash, ok := strings.CutPrefix(value, androidOriginPrefix); ok {
+		sum, err := b64.RawURLEncoding.DecodeString(hash)
+		if err != nil || len(sum) != 32 {
+			return "", fmt.Errorf("invalid origin %q, the APK key hash must be an unpadded base64url SHA-256 hash", value)
+		}
+		return value, nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid origin %q, expected scheme://host[:port] or %s<hash>", value, androidOriginPrefix)
+	}
+
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("invalid origin %q, origins can't have a path, query or credentials", value)
+	}
+
+	return u.Scheme + "://" + strings.ToLower(u.Host), nil
+}
+
+// validateRPOrigins checks that rpID is a registrable domain suffix of the
+// host of every web origin, as browsers require
+//
+// Android app origins are bound to the RP ID through the Digital Asset Links
+// of the RP ID's domain and can't be checked here.
+func validateRPOrigins(rpID string, origins []string) error {
+	var errs []error
+
+	rpIsIP := net.ParseIP(rpID) != nil
+
+	if rpID == "" {
+		errs = append(errs, errors.New("RP ID is empty"))
+	} else if !rpIsIP && rpID != "localhost" {
+		if _, err := publicsuffix.EffectiveTLDPlusOne(rpID); err != nil {
+			errs = append(errs, fmt.Errorf("RP ID %q is not a registrable domain: %w", rpID, err))
+		}
+	}
+
+	for _, origin := range origins {
+		if strings.HasPrefix(origin, androidOriginPrefix) {
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || u.Hostname() == "" {
+			errs = append(errs, fmt.Errorf("invalid origin %q", origin))
+			continue
+		}
+
+		host := strings.ToLower(u.Hostname())
+
+		if rpIsIP || net.ParseIP(host) != nil {
+			if host != rpID {
+				errs = append(errs, fmt.Errorf("origin %q must use the RP ID %q as its host", origin, rpID))
+			}
+			continue
+		}
+
+		if host != rpID && !strings.HasSuffix(host, "."+rpID) {
+			errs = append(errs, fmt.Errorf("RP ID %q is not a suffix of the origin %q", rpID, origin))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// HandleRelatedOrigins serves the related origins document listing the web
+// origins allowed to use the RP ID, for browsers that check it before
+// accepting a ceremony from an origin
+func (h *WebAuthnHandlers) HandleRelatedOrigins(e *core.RequestEvent) error {
+	origins := []string{}
+
+	for _, origin := range h.auth.GetConfig().RPOrigins() {
+		if !strings.HasPrefix(origin, androidOriginPrefix) {
+			origins = append(origins, origin)
+		}
+	}
+
+	e.Response.Header().Set("Cache-Control", "public, max-age=3600")
+
+	return e.JSON(http.StatusOK, RelatedOrigins{Origins: origins})
+}
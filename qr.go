@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"mime"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/pquerna/otp"
+)
+
+// Representations of the TOTP key served by HandleGetQR
+const (
+	QRFormatPNG  = "png"
+	QRFormatSVG  = "svg"
+	QRFormatJSON = "json"
+)
+
+// Default and bounds of the QR code size in pixels
+const (
+	defaultQRSize = 200
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// qrQuietZone is the blank border, in modules, scanners need around the code
+const qrQuietZone = 4
+
+// negotiateQRFormat picks the representation from the explicit format
+// query parameter or else from the Accept header, defaulting to PNG
+func negotiateQRFormat(format string, accept string) (string, error) {
+	switch strings.ToLower(format) {
+	case QRFormatPNG, QRFormatSVG, QRFormatJSON:
+		return strings.ToLower(format), nil
+	case "":
+	default:
+		return "", fmt.Errorf("format must be %q, %q or %q", QRFormatPNG, QRFormatSVG, QRFormatJSON)
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case "application/json":
+			return QRFormatJSON, nil
+		case "image/svg+xml":
+			return QRFormatSVG, nil
+		case "image/png":
+			return QRFormatPNG, nil
+		}
+	}
+
+	return QRFormatPNG, nil
+}
+
+// renderQRPNG renders the key's otpauth URI as a size x size PNG
+func renderQRPNG(key *otp.Key, size int) ([]byte, error) {
+	img, err := key.Image(size, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// renderQRSVG renders the key's otpauth URI as a size x size SVG, which
+// stays sharp at any scale
+func renderQRSVG(key *otp.Key, size int) ([]byte, error) {
+	code, err := qr.Encode(key.URL(), qr.M, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+
+	modules := code.Bounds().Dx()
+	dimension := modules + 2*qrQuietZone
+
+	var path strings.Builder
+	for y := 0; y < modules; y++ {
+		for x := 0; x < modules; x++ {
+			if isDarkModule(code, x, y) {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, dimension, dimension)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/>`, dimension, dimension)
+	fmt.Fprintf(&buf, `<path d="%s" fill="#000"/>`, path.String())
+	buf.WriteString(`</svg>`)
+
+	return buf.Bytes(), nil
+}
+
+func isDarkModule(code barcode.Barcode, x int, y int) bool {
+	gray := color.GrayModel.Convert(code.At(x, y)).(color.Gray)
+
+	return gray.Y < 128
+}
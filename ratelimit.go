@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// RateLimitPolicy describes how many attempts a key gets per window and how
+// long it is locked out once they are used up
+type RateLimitPolicy struct {
+	// MaxAttempts per Window before a lockout, 0 disables the limiter
+	MaxAttempts int
+	Window      time.Duration
+	// Lockout is the first lockout duration, doubled for every repeated
+	// lockout of the same key up to MaxLockout
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+type rateLimitEntry struct {
+	attempts    int
+	windowStart time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// RateLimiter counts attempts per key (client IP, user, MFA id...) and locks
+// out keys that exceed their policy with exponential backoff
+type RateLimiter struct {
+	mu        sync.Mutex
+	policy    RateLimitPolicy
+	entries   map[string]*rateLimitEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewRateLimiter creates a rate limiter enforcing policy
+func NewRateLimiter(policy RateLimitPolicy) *RateLimiter {
+	return &RateLimiter{
+		policy:  policy,
+		entries: make(map[string]*rateLimitEntry),
+		now:     time.Now,
+	}
+}
+
+// RetryAfter returns the longest remaining lockout among keys, 0 when none is locked
+func (l *RateLimiter) RetryAfter(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	var retryAfter time.Duration
+	for _, key := range keys {
+		entry, ok := l.entries[key]
+		if !ok {
+			continue
+		}
+		if remaining := entry.lockedUntil.Sub(now); remaining > retryAfter {
+			retryAfter = remaining
+		}
+	}
+
+	return retryAfter
+}
+
+// Hit records an attempt for key and returns the lockout duration when the
+// attempt used up the key's allowance, 0 otherwise
+func (l *RateLimiter) Hit(key string) time.Duration {
+	if l.policy.MaxAttempts <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	if now.Sub(l.lastSweep) >= l.policy.Window {
+		l.deleteExpired(now)
+		l.lastSweep = now
+	}
+
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &rateLimitEntry{windowStart: now}
+		l.entries[key] = entry
+	}
+
+	// Keys that behaved for a full max lockout start over with the base lockout
+	if entry.lockouts > 0 && now.After(entry.lockedUntil.Add(l.policy.MaxLockout)) {
+		entry.lockouts = 0
+	}
+
+	if now.Sub(entry.windowStart) >= l.policy.Window {
+		entry.attempts = 0
+		entry.windowStart = now
+	}
+
+	entry.attempts++
+	if entry.attempts < l.policy.MaxAttempts {
+		return 0
+	}
+
+	entry.lockouts++
+	lockout := l.lockoutFor(entry.lockouts)
+	entry.lockedUntil = now.Add(lockout)
+	entry.attempts = 0
+	entry.windowStart = now
+
+	return lockout
+}
+
+// Reset forgets all attempts and lockouts of key
+func (l *RateLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+// lockoutFor returns the backoff for the n-th consecutive lockout
+func (l *RateLimiter) lockoutFor(n int) time.Duration {
+	factor := math.Pow(2, float64(n-1))
+	if float64(l.policy.Lockout)*factor >= float64(l.policy.MaxLockout) {
+		return l.policy.MaxLockout
+	}
+
+	return time.Duration(float64(l.policy.Lockout) * factor)
+}
+
+// deleteExpired drops entries with neither recent attempts nor a lockout
+// history that still counts toward the backoff, must be called with l.mu held
+func (l *RateLimiter) deleteExpired(now time.Time) int {
+	deleted := 0
+	for key, entry := range l.entries {
+		if now.Sub(entry.windowStart) < l.policy.Window {
+			continue
+		}
+		if entry.lockouts > 0 && !now.After(entry.lockedUntil.Add(l.policy.MaxLockout)) {
+			continue
+		}
+		delete(l.entries, key)
+		deleted++
+	}
+
+	return deleted
+}
+
+// RateLimitRequests returns a middleware limiting how many requests a single
+// client IP can make to the routes it is bound to
+func RateLimitRequests(limiter *RateLimiter, log Logger) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		key := "ip:" + e.RealIP()
+
+		if err := checkRateLimit(e, limiter, key); err != nil {
+			return err
+		}
+
+		if lockout := limiter.Hit(key); lockout > 0 {
+			auditLockout(e, log, key, lockout)
+		}
+
+		return e.Next()
+	}
+}
+
+// checkRateLimit returns a 429 error with Retry-After when any of keys is locked out
+func checkRateLimit(e *core.RequestEvent, limiter *RateLimiter, keys ...string) error {
+	retryAfter := limiter.RetryAfter(keys...)
+	if retryAfter <= 0 {
+		return nil
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	e.Response.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	return e.TooManyRequestsError("Too many attempts, please try again later", nil)
+}
+
+// registerFailure counts a failed attempt against each of keys and audits
+// every lockout it triggers
+func registerFailure(e *core.RequestEvent, limiter *RateLimiter, log Logger, keys ...string) {
+	for _, key := range keys {
+		if lockout := limiter.Hit(key); lockout > 0 {
+			auditLockout(e, log, key, lockout)
+		}
+	}
+}
+
+// auditLockout records a lockout in the server log and in the app logs
+func auditLockout(e *core.RequestEvent, log Logger, key string, lockout time.Duration) {
+	log.Printf("[SECURITY] Rate Limit: Locked out %s for %s (ip: %s, path: %s)", key, lockout, e.RealIP(), e.Request.URL.Path)
+
+	e.App.Logger().Warn(
+		"Rate limit lockout",
+		"key", key,
+		"lockout", lockout.String(),
+		"ip", e.RealIP(),
+		"path", e.Request.URL.Path,
+	)
+}
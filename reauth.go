@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Methods accepted as proof of identity by reauthenticate
+const (
+	ReauthMethodTOTP     = "totp"
+	ReauthMethodPassword = "password"
+	ReauthMethodPasskey  = "passkey"
+)
+
+// reauthKeyHeader carries the session id of a passkey re-authentication ceremony
+const reauthKeyHeader = "Reauth-Key"
+
+// errReauthFailed distinguishes a wrong proof from internal failures
+var errReauthFailed = errors.New("re-authentication failed")
+
+// ReauthRequest is the body of endpoints that require re-authentication
+// without a passkey assertion
+type ReauthRequest struct {
+	Passcode string `json:"passcode" form:"passcode"`
+	Password string `json:"password" form:"password"`
+}
+
+// reauthenticate verifies a fresh proof of identity for record sent along
+// with the request and returns the method used
+//
+// The proof is either a passkey assertion (body) for a ceremony started via
+// HandleReauthStart (Reauth-Key header), a current TOTP passcode or the
+// account password. The returned errors are API errors ready to be returned
+// by the handler.
+func reauthenticate(e *core.RequestEvent, auth *AuthService, record *core.Record) (string, error) {
+	return verifyIdentity(e, auth, record, true)
+}
+
+// verifyIdentity implements reauthenticate, allowPassword=false accepts only
+// the strong passkey and TOTP proofs
+func verifyIdentity(e *core.RequestEvent, auth *AuthService, record *core.Record, allowPassword bool) (string, error) {
+	limiter := auth.GetFailureLimiter()
+	failureKeys := []string{"ip:" + e.RealIP(), "user:" + record.Id}
+	if err := checkRateLimit(e, limiter, failureKeys...); err != nil {
+		auth.GetLogger().Printf("[SECURITY] Reauth: Throttled attempt for user: %s", record.Id)
+		return "", err
+	}
+
+	var method string
+	var err error
+
+	if sessionID := e.Request.Header.Get(reauthKeyHeader); sessionID != "" {
+		method = ReauthMethodPasskey
+		err = verifyReauthPasskey(e, auth, record, sessionID)
+	} else {
+		var data ReauthRequest
+		if bindErr := e.BindBody(&data); bindErr != nil {
+			auth.GetLogger().Printf("[WARN] Reauth: Invalid request body: %v", bindErr)
+			return "", e.BadRequestError("Invalid request format", nil)
+		}
+
+		switch {
+		case data.Passcode != "":
+			method = ReauthMethodTOTP
+			err = verifyReauthPasscode(e, auth, record, data.Passcode)
+		case data.Password != "" && allowPassword:
+			method = ReauthMethodPassword
+			if !record.ValidatePassword(data.Password) {
+				err = errReauthFailed
+			}
+		case allowPassword:
+			return "", e.BadRequestError("Confirm with a passkey, a TOTP passcode or your password", nil)
+		default:
+			return "", e.BadRequestError("Confirm with a passkey or a TOTP passcode", nil)
+		}
+	}
+
+	if errors.Is(err, errReauthFailed) {
+		auth.GetLogger().Printf("[SECURITY] Reauth: Failed %s re-authentication for user: %s", method, record.Id)
+		registerFailure(e, limiter, auth.GetLogger(), failureKeys...)
+		return "", e.UnauthorizedError("Re-authentication failed", nil)
+	}
+	if err != nil {
+		auth.GetLogger().Printf("[ERROR] Reauth: Failed to verify %s for user: %s, error: %v", method, record.Id, err)
+		return "", e.InternalServerError("Failed to verify re-authentication", nil)
+	}
+
+	limiter.Reset("user:" + record.Id)
+
+	return method, nil
+}
+
+// verifyReauthPasscode checks and consumes a TOTP passcode of record
+func verifyReauthPasscode(e *core.RequestEvent, auth *AuthService, record *core.Record, passcode string) error {
+	secret, err := getTOTPSecret(auth.GetSecretCipher(), record, totpSecretField)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return errReauthFailed
+	}
+
+	params := userTOTPParams(auth.GetConfig(), record)
+	usedAt, ok := matchTOTPCode(params, auth.GetConfig().TOTPSkew, passcode, secret, time.Now())
+	if !ok {
+		return errReauthFailed
+	}
+
+	if err := consumeTOTPCode(e.App, record.Id, usedAt); err != nil {
+		if errors.Is(err, ErrTOTPReplay) {
+			return errReauthFailed
+		}
+		return err
+	}
+
+	return nil
+}
+
+// verifyReauthPasskey completes the passkey ceremony of sessionID, which
+// must have been started for record
+func verifyReauthPasskey(e *core.RequestEvent, auth *AuthService, record *core.Record, sessionID string) error {
+	session, ok := auth.GetDatastore().GetSession(sessionID)
+	if !ok || session.UserId != record.Id {
+		return errReauthFailed
+	}
+
+	// The session is single use regardless of the outcome
+	auth.GetDatastore().DeleteSession(sessionID)
+
+	user, err := auth.GetDatastore().GetUser(record.Id)
+	if err != nil {
+		return err
+	}
+
+	credential, err := auth.GetWebAuthn().FinishLogin(user, session.SessionData, e.Request)
+	if err != nil {
+		auth.GetLogger().Printf("[SECURITY] Reauth: Failed to verify passkey for user: %s, error: %v", record.Id, err)
+		return errReauthFailed
+	}
+
+	if credential.Authenticator.CloneWarning {
+		auth.GetLogger().Printf("[SECURITY] Reauth: Sign count regression (possible cloned authenticator) for user: %s, credential: %s",
+			record.Id, URLEncodedBase64(credential.ID))
+
+		if auth.GetConfig().CloneWarningPolicy == CloneWarningPolicyBlock {
+			if err := user.FlagCloneWarning(e.App, credential.ID); err != nil {
+				auth.GetLogger().Printf("[ERROR] Reauth: Failed to flag cloned credential for user: %s, credential: %s, error: %v", record.Id, URLEncodedBase64(credential.ID), err)
+			}
+			return errReauthFailed
+		}
+	}
+
+	return user.UpdateCredential(e.App, credential)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// recoveryCodesCollection is the system collection holding hashed TOTP recovery codes
+const recoveryCodesCollection = "_totpRecoveryCodes"
+
+const (
+	// recoveryCodeCount is the number of codes issued per batch
+	recoveryCodeCount = 10
+	// recoveryCodeLength excludes the separator added for readability
+	recoveryCodeLength = 10
+	// recoveryCodeAlphabet leaves out easily confused characters (0/o, 1/l/i)
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// ErrInvalidRecoveryCode is returned for unknown or already used recovery codes
+var ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+
+// hashRecoveryCode hashes a normalized recovery code
+//
+// A plain SHA-256 is enough here: codes are random with ~49 bits of entropy,
+// single use and only accepted behind the rate limited MFA step.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeRecoveryCode drops separators, whitespace and casing from user input
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// generateRecoveryCodes replaces all recovery codes of the user with a new
+// batch and returns the plaintext codes, which are never stored
+func generateRecoveryCodes(app core.App, userId string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		collection, err := txApp.FindCachedCollectionByNameOrId(recoveryCodesCollection)
+		if err != nil {
+			return err
+		}
+
+		if err := deleteRecoveryCodes(txApp, userId); err != nil {
+			return err
+		}
+
+		for i := range codes {
+			raw := security.RandomStringWithAlphabet(recoveryCodeLength, recoveryCodeAlphabet)
+			codes[i] = raw[:recoveryCodeLength/2] + "-" + raw[recoveryCodeLength/2:]
+
+			record := core.NewRecord(collection)
+			record.Set("user", userId)
+			record.Set("codeHash", hashRecoveryCode(codes[i]))
+
+			if err := txApp.Save(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// deleteRecoveryCodes revokes all recovery codes of the user
+func deleteRecoveryCodes(app core.App, userId string) error {
+	records, err := app.FindAllRecords(recoveryCodesCollection, dbx.HashExp{"user": userId})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := app.Delete(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// consumeRecoveryCode marks a valid unused recovery code of the user as used
+// and returns how many unused codes are left
+func consumeRecoveryCode(app core.App, userId string, code string) (int, error) {
+	remaining := 0
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		record, err := txApp.FindFirstRecordByFilter(recoveryCodesCollection,
+			"user = {:user} && codeHash = {:hash} && used = ''",
+			dbx.Params{"user": userId, "hash": hashRecoveryCode(code)},
+		)
+		if err != nil {
+			return ErrInvalidRecoveryCode
+		}
+
+		record.Set("used", types.NowDateTime())
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+
+		remaining, err = countRecoveryCodes(txApp, userId)
+
+		return err
+	})
+
+	return remaining, err
+}
+
+// countRecoveryCodes returns the number of unused recovery codes of the user
+func countRecoveryCodes(app core.App, userId string) (int, error) {
+	total, err := app.CountRecords(recoveryCodesCollection,
+		dbx.HashExp{"user": userId},
+		dbx.NewExp("[[used]] = ''"),
+	)
+
+	return int(total), err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// signupTokenType is the "type" claim of passkey sign-up link tokens
+const signupTokenType = "passkeySignup"
+
+// newSignupToken issues a token proving control of email for a passkey-only
+// sign-up. It is signed with the users collection verification secret.
+func newSignupToken(usersCollection *core.Collection, email string) (string, error) {
+	return security.NewJWT(
+		jwt.MapClaims{
+			"type":         signupTokenType,
+			"collectionId": usersCollection.Id,
+			"email":        email,
+		},
+		usersCollection.VerificationToken.Secret,
+		usersCollection.VerificationToken.DurationTime(),
+	)
+}
+
+// parseSignupToken validates a sign-up token and returns its email
+func parseSignupToken(usersCollection *core.Collection, token string) (string, error) {
+	claims, err := security.ParseJWT(token, usersCollection.VerificationToken.Secret)
+	if err != nil {
+		return "", err
+	}
+
+	if claims["type"] != signupTokenType || claims["collectionId"] != usersCollection.Id {
+		return "", errors.New("not a passkey sign-up token")
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return "", errors.New("missing email claim")
+	}
+
+	return email, nil
+}
+
+// sendSignupEmail emails the link that continues a passkey sign-up
+func sendSignupEmail(app core.App, config *AppConfig, email string, token string) error {
+	link := fmt.Sprintf("%s/login/passkey?is_sign_up=true&token=%s", config.Origin, url.QueryEscape(token))
+
+	message := &mailer.Message{
+		From: mail.Address{
+			Name:    app.Settings().Meta.SenderName,
+			Address: app.Settings().Meta.SenderAddress,
+		},
+		To:      []mail.Address{{Address: email}},
+		Subject: "Finish creating your " + app.Settings().Meta.AppName + " account",
+		HTML: fmt.Sprintf(`<p>Hello,</p>
+<p>Click on the button below to create your account with a passkey.</p>
+<p>
+  <a class="btn" href="%s" target="_blank" rel="noopener">Create account</a>
+</p>
+<p><i>If you didn't ask to sign up, you can ignore this email.</i></p>`, link),
+	}
+
+	return app.NewMailClient().Send(message)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// strongAuthsCollection is the system collection storing when the holder of
+// an auth token last proved a TOTP or passkey factor
+const strongAuthsCollection = "_strongAuths"
+
+// strongAuthKey marks requests whose auth response completes a TOTP or
+// passkey authentication
+const strongAuthKey = "strongAuth"
+
+// defaultStepUpMaxAge is used when no StepUpMaxAge is configured
+const defaultStepUpMaxAge = 5 * time.Minute
+
+// stepUpChallengeCode identifies a StepUpChallenge among 401 responses
+const stepUpChallengeCode = "step_up_required"
+
+// StepUpChallenge is the 401 body of requests that need a fresh strong
+// authentication, to be satisfied via the step-up endpoint
+type StepUpChallenge struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Methods []string `json:"methods"`
+	MaxAge  int      `json:"maxAge"`
+}
+
+// StepUpResponse reports a successful step-up
+type StepUpResponse struct {
+	Method     string         `json:"method"`
+	ValidUntil types.DateTime `json:"validUntil"`
+}
+
+// RequireStepUp only lets requests through whose users auth token was
+// strongly authenticated within the configured max age, and answers the
+// others with a StepUpChallenge
+//
+// Requests without a users auth record are left to apis.RequireAuth, and
+// users without TOTP or passkeys have nothing to step up with.
+func RequireStepUp(auth *AuthService) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if ok, err := checkStepUp(e, auth); !ok {
+			return err
+		}
+
+		return e.Next()
+	}
+}
+
+// checkStepUp reports whether the request may continue, having written the
+// challenge response when it may not
+func checkStepUp(e *core.RequestEvent, auth *AuthService) (bool, error) {
+	if e.Auth == nil || e.Auth.Collection().Name != "users" {
+		return true, nil
+	}
+
+	maxAge := stepUpMaxAge(auth.GetConfig())
+
+	last, err := lastStrongAuth(e.App, e.Auth.Id, requestAuthToken(e))
+	if err != nil {
+		auth.GetLogger().Printf("[ERROR] Step-up: Failed to load authentication for user: %s, error: %v", e.Auth.Id, err)
+		return false, e.InternalServerError("Failed to check authentication", nil)
+	}
+	if !last.IsZero() && time.Since(last.Time()) <= maxAge {
+		return true, nil
+	}
+
+	methods, err := strongAuthMethods(e.App, e.Auth)
+	if err != nil {
+		auth.GetLogger().Printf("[ERROR] Step-up: Failed to list methods for user: %s, error: %v", e.Auth.Id, err)
+		return false, e.InternalServerError("Failed to check authentication", nil)
+	}
+	if len(methods) == 0 {
+		return true, nil
+	}
+
+	auth.GetLogger().Printf("[SECURITY] Step-up: Required for user: %s, path: %s", e.Auth.Id, e.Request.URL.Path)
+
+	seconds := int(maxAge / time.Second)
+	e.Response.Header().Set("WWW-Authenticate",
+		fmt.Sprintf(`Bearer error="insufficient_user_authentication", max_age=%d`, seconds))
+
+	return false, e.JSON(http.StatusUnauthorized, StepUpChallenge{
+		Code:    stepUpChallengeCode,
+		Message: "Confirm it's you to continue",
+		Methods: methods,
+		MaxAge:  seconds,
+	})
+}
+
+// stepUpMaxAge returns the configured max age or the default
+func stepUpMaxAge(config *AppConfig) time.Duration {
+	if config.StepUpMaxAge == 0 {
+		return defaultStepUpMaxAge
+	}
+
+	return config.StepUpMaxAge
+}
+
+// strongAuthMethods lists the step-up methods the user has set up
+func strongAuthMethods(app core.App, record *core.Record) ([]string, error) {
+	methods := []string{}
+
+	if record.GetString(totpSecretField) != "" {
+		methods = append(methods, ReauthMethodTOTP)
+	}
+
+	passkeys, err := app.CountRecords("credentials", dbx.HashExp{"user_id": record.Id})
+	if err != nil {
+		return nil, err
+	}
+	if passkeys > 0 {
+		methods = append(methods, ReauthMethodPasskey)
+	}
+
+	return methods, nil
+}
+
+// requestAuthToken returns the auth token the request was sent with
+func requestAuthToken(e *core.RequestEvent) string {
+	return strings.TrimPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+}
+
+// hashAuthToken identifies an auth token without storing it
+func hashAuthToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// lastStrongAuth returns when the holder of one of the user's auth tokens
+// last strongly authenticated, zero if it never did
+func lastStrongAuth(app core.App, userId string, token string) (types.DateTime, error) {
+	if token == "" {
+		return types.DateTime{}, nil
+	}
+
+	record, err := app.FindFirstRecordByFilter(strongAuthsCollection,
+		"user = {:user} && tokenHash = {:hash}",
+		dbx.Params{"user": userId, "hash": hashAuthToken(token)},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.DateTime{}, nil
+	}
+	if err != nil {
+		return types.DateTime{}, err
+	}
+
+	return record.GetDateTime("authenticated"), nil
+}
+
+// recordStrongAuth marks the holder of one of the user's auth tokens as
+// strongly authenticated at the given time
+//
+// The records of the user's tokens that have expired by now are dropped.
+func recordStrongAuth(app core.App, userId string, token string, authenticated types.DateTime) error {
+	collection, err := app.FindCachedCollectionByNameOrId(strongAuthsCollection)
+	if err != nil {
+		return err
+	}
+
+	hash := hashAuthToken(token)
+
+	record, err := app.FindFirstRecordByFilter(collection,
+		"user = {:user} && tokenHash = {:hash}",
+		dbx.Params{"user": userId, "hash": hash},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		record = core.NewRecord(collection)
+		record.Set("user", userId)
+		record.Set("tokenHash", hash)
+	} else if err != nil {
+		return err
+	}
+
+	record.Set("authenticated", authenticated)
+	if err := app.Save(record); err != nil {
+		return err
+	}
+
+	return deleteExpiredStrongAuths(app, userId)
+}
+
+// deleteExpiredStrongAuths drops the records of the user's auth tokens that
+// expired, which can't be used for anything anymore
+func deleteExpiredStrongAuths(app core.App, userId string) error {
+	users, err := app.FindCachedCollectionByNameOrId("users")
+	if err != nil {
+		return err
+	}
+
+	expired, err := types.ParseDateTime(time.Now().Add(-users.AuthToken.DurationTime()))
+	if err != nil {
+		return err
+	}
+
+	records, err := app.FindAllRecords(strongAuthsCollection,
+		dbx.HashExp{"user": userId},
+		dbx.NewExp("[[authenticated]] < {:expired}", dbx.Params{"expired": expired.String()}),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := app.Delete(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bindStrongAuthToken is an OnRecordAuthRequest hook recording the strong
+// authentication of requests marked with strongAuthKey for the issued token
+//
+// A token issued to a request sent with a strongly authenticated token of
+// the same user, as on auth refreshes, takes over its time.
+func bindStrongAuthToken(e *core.RecordAuthRequestEvent) error {
+	if err := e.Next(); err != nil {
+		return err
+	}
+
+	if strong, _ := e.Get(strongAuthKey).(bool); strong {
+		return recordStrongAuth(e.App, e.Record.Id, e.Token, types.NowDateTime())
+	}
+
+	last, err := lastStrongAuth(e.App, e.Record.Id, requestAuthToken(e.RequestEvent))
+	if err == nil && !last.IsZero() {
+		err = recordStrongAuth(e.App, e.Record.Id, e.Token, last)
+	}
+	if err != nil {
+		// without its predecessor's time the new token merely has to step up
+		e.App.Logger().Warn("Failed to carry over strong authentication", "error", err, "userId", e.Record.Id)
+	}
+
+	return nil
+}
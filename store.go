@@ -1,99 +1,240 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
-	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
-	"github.com/pocketbase/pocketbase/tools/store"
 )
 
+// ErrUserNotFound is returned by user lookups for unknown users
+var ErrUserNotFound = errors.New("user not found")
+
+// SessionLimits bounds how long and how many ceremony sessions the in-memory store keeps
+type SessionLimits struct {
+	// TTL applies to sessions whose webauthn.SessionData carries no expiry
+	TTL time.Duration
+	// MaxSessions caps the total number of sessions (0 = unlimited)
+	MaxSessions int
+	// MaxPerEmail caps the sessions per email address (0 = unlimited)
+	MaxPerEmail int
+}
+
+// DefaultSessionLimits returns the limits used when none are configured
+func DefaultSessionLimits() SessionLimits {
+	return SessionLimits{
+		TTL:         5 * time.Minute,
+		MaxSessions: 10000,
+		MaxPerEmail: 5,
+	}
+}
+
+// InMem keeps ceremony sessions in memory, evicting the least recently
+// used ones once the configured limits are reached
 type InMem struct {
-	sessions *store.Store[string, LocalSession]
+	mu       sync.Mutex
+	sessions map[string]*list.Element
+	lru      *list.List // front is the most recently used session
+	limits   SessionLimits
 	log      Logger
-	app      *pocketbase.PocketBase
+	app      core.App
 }
 
-func (i *InMem) GenSessionID() (string, error) {
-	b := make([]byte, 32)
-	_, err := rand.Read(b)
-	if err != nil {
-		return "", err
+// inMemEntry is the value stored in InMem.lru
+type inMemEntry struct {
+	token   string
+	session LocalSession
+	expires time.Time
+}
+
+// NewDatastore creates the PasskeyStore selected by config.SessionStore
+func NewDatastore(config *AppConfig, log Logger, app core.App) (PasskeyStore, error) {
+	switch config.SessionStore {
+	case SessionStoreDB:
+		return NewDBStore(log, app, config.SessionTTL), nil
+	case SessionStoreMemory, "":
+		return NewInMemWithLimits(log, app, SessionLimits{
+			TTL:         config.SessionTTL,
+			MaxSessions: config.SessionMaxTotal,
+			MaxPerEmail: config.SessionMaxPerEmail,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown session store %q", config.SessionStore)
 	}
+}
 
-	return base64.URLEncoding.EncodeToString(b), nil
+func (i *InMem) GenSessionID() (string, error) {
+	return genSessionID()
+}
 
+// NewInMem creates an in-memory store with DefaultSessionLimits
+func NewInMem(log Logger, app core.App) *InMem {
+	return NewInMemWithLimits(log, app, DefaultSessionLimits())
 }
 
-func NewInMem(log Logger, app *pocketbase.PocketBase) *InMem {
+// NewInMemWithLimits creates an in-memory store with custom limits
+func NewInMemWithLimits(log Logger, app core.App, limits SessionLimits) *InMem {
+	if limits.TTL <= 0 {
+		limits.TTL = DefaultSessionLimits().TTL
+	}
+
 	return &InMem{
-		sessions: store.New[string, LocalSession](nil),
+		sessions: make(map[string]*list.Element),
+		lru:      list.New(),
+		limits:   limits,
 		log:      log,
 		app:      app,
 	}
 }
 
 func (i *InMem) GetSession(token string) (LocalSession, bool) {
-	i.log.Printf("[DEBUG] GetSession: %v", i.sessions.Get(token))
-	val, ok := i.sessions.GetOk(token)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	el, ok := i.sessions[token]
+	if !ok {
+		i.log.Printf("[DEBUG] GetSession: session not found: %s", token)
+		return LocalSession{}, false
+	}
+
+	entry := el.Value.(*inMemEntry)
+	if entry.expires.Before(time.Now()) {
+		i.log.Printf("[DEBUG] GetSession: session expired: %s", token)
+		i.remove(el)
+		return LocalSession{}, false
+	}
+
+	i.lru.MoveToFront(el)
 
-	return val, ok
+	i.log.Printf("[DEBUG] GetSession: %v", entry.session)
+
+	return entry.session, true
 }
 
 func (i *InMem) SaveSession(token string, data LocalSession) {
 	i.log.Printf("[DEBUG] SaveSession: %s - %v", token, data)
-	i.sessions.Set(token, data)
+
+	expires := data.SessionData.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(i.limits.TTL)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if el, ok := i.sessions[token]; ok {
+		i.remove(el)
+	}
+
+	if i.limits.MaxPerEmail > 0 && data.Email != "" {
+		for i.countEmail(data.Email) >= i.limits.MaxPerEmail {
+			i.evictOldest(func(e *inMemEntry) bool { return e.session.Email == data.Email })
+		}
+	}
+
+	if i.limits.MaxSessions > 0 {
+		for i.lru.Len() >= i.limits.MaxSessions {
+			i.evictOldest(nil)
+		}
+	}
+
+	i.sessions[token] = i.lru.PushFront(&inMemEntry{
+		token:   token,
+		session: data,
+		expires: expires,
+	})
 }
 
 func (i *InMem) DeleteSession(token string) {
 	i.log.Printf("[DEBUG] DeleteSession: %v", token)
-	i.sessions.Remove(token)
-}
 
-func (i *InMem) GetOrCreateUser(email string) (PasskeyUser, error) {
-	i.log.Printf("[DEBUG] GetOrCreateUser: %v", email)
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
-	_, err := i.app.FindFirstRecordByData("users", "email", email)
-	if err != nil {
-		collection, err := i.app.FindCollectionByNameOrId("users")
-		if err != nil {
-			return nil, err
-		}
+	if el, ok := i.sessions[token]; ok {
+		i.remove(el)
+	}
+}
 
-		record := core.NewRecord(collection)
+// DeleteExpiredSessions removes every session past its expiry
+func (i *InMem) DeleteExpiredSessions() (int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
-		record.Set("email", email)
-		record.Set("name", email)
+	now := time.Now()
+	deleted := 0
 
-		generatedPassword := make([]byte, 20)
-		_, randErr := rand.Reader.Read(generatedPassword)
-		if randErr != nil {
-			return nil, randErr
+	for el := i.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*inMemEntry).expires.Before(now) {
+			i.remove(el)
+			deleted++
 		}
+		el = prev
+	}
 
-		record.SetPassword(string(generatedPassword))
+	return deleted, nil
+}
+
+// remove drops el from both the index and the LRU list. Callers must hold i.mu.
+func (i *InMem) remove(el *list.Element) {
+	delete(i.sessions, el.Value.(*inMemEntry).token)
+	i.lru.Remove(el)
+}
 
-		err = i.app.Save(record)
-		if err != nil {
-			return nil, err
+// evictOldest removes the least recently used session matching filter
+// (any session when filter is nil). Callers must hold i.mu.
+func (i *InMem) evictOldest(filter func(*inMemEntry) bool) {
+	for el := i.lru.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*inMemEntry)
+		if filter == nil || filter(entry) {
+			i.log.Printf("[DEBUG] SaveSession: evicting session %s (limit reached)", entry.token)
+			i.remove(el)
+			return
 		}
 	}
+}
 
-	userRecord, userErr := i.app.FindFirstRecordByData("users", "email", email)
-	if userErr != nil {
-		return nil, userErr
+// countEmail returns the number of sessions held for email. Callers must hold i.mu.
+func (i *InMem) countEmail(email string) int {
+	count := 0
+	for el := i.lru.Front(); el != nil; el = el.Next() {
+		if el.Value.(*inMemEntry).session.Email == email {
+			count++
+		}
 	}
 
-	user := &User{
-		ID:          []byte(email),
-		DisplayName: userRecord.GetString("name"),
-		Name:        userRecord.GetString("name"),
-		app:         i.app,
-	}
+	return count
+}
 
-	return user, nil
+func (i *InMem) CreateUser(txApp core.App, email string, userHandle []byte) (PasskeyUser, error) {
+	i.log.Printf("[DEBUG] CreateUser: %v", email)
+
+	return createUserWithHandle(txApp, email, base64.RawURLEncoding.EncodeToString(userHandle))
+}
+
+func (i *InMem) GetUserByEmail(email string) (PasskeyUser, error) {
+	i.log.Printf("[DEBUG] GetUserByEmail: %v", email)
+
+	return getUserByEmail(i.app, email)
+}
+
+func (i *InMem) GetUser(recordId string) (PasskeyUser, error) {
+	i.log.Printf("[DEBUG] GetUser: %v", recordId)
 
+	return getUser(i.app, recordId)
+}
+
+func (i *InMem) GetUserByCredential(rawID, userHandle []byte) (PasskeyUser, error) {
+	i.log.Printf("[DEBUG] GetUserByCredential: %s", base64.RawURLEncoding.EncodeToString(rawID))
+
+	return getUserByCredential(i.app, rawID, userHandle)
 }
 
 func (i *InMem) SaveUser(user PasskeyUser) {
@@ -101,3 +242,120 @@ func (i *InMem) SaveUser(user PasskeyUser) {
 	//i.log.Printf("[DEBUG] SaveUser: %v", user)
 	//i.users.Set(user.WebAuthnName(), user)
 }
+
+// genSessionID returns a random URL-safe session token
+func genSessionID() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// createUserWithHandle creates a users record for email with a random
+// password and the given base64url encoded user handle
+func createUserWithHandle(app core.App, email string, handle string) (PasskeyUser, error) {
+	collection, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		return nil, err
+	}
+
+	record := core.NewRecord(collection)
+
+	record.Set("email", email)
+	record.Set("name", email)
+	record.Set(userHandleField, handle)
+
+	generatedPassword := make([]byte, 20)
+	_, randErr := rand.Reader.Read(generatedPassword)
+	if randErr != nil {
+		return nil, randErr
+	}
+
+	record.SetPassword(string(generatedPassword))
+
+	err = app.Save(record)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUser(app, record)
+}
+
+// getUserByEmail loads the users record for email
+func getUserByEmail(app core.App, email string) (PasskeyUser, error) {
+	userRecord, err := app.FindAuthRecordByEmail("users", email)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	return newUser(app, userRecord)
+}
+
+// getUser loads the users record with the given id
+func getUser(app core.App, recordId string) (PasskeyUser, error) {
+	userRecord, err := app.FindRecordById("users", recordId)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	return newUser(app, userRecord)
+}
+
+// getUserByCredential resolves the owner of a discoverable credential and
+// checks that the authenticator's user handle belongs to that owner
+func getUserByCredential(app core.App, rawID, userHandle []byte) (PasskeyUser, error) {
+	credentialRecord, err := app.FindFirstRecordByData("credentials", "credential_id", base64.StdEncoding.EncodeToString(rawID))
+	if err != nil {
+		return nil, fmt.Errorf("credential not found: %w", err)
+	}
+
+	userRecord, err := app.FindRecordById("users", credentialRecord.GetString("user_id"))
+	if err != nil {
+		return nil, fmt.Errorf("credential owner not found: %w", err)
+	}
+
+	user, err := newUser(app, userRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(user.WebAuthnID(), userHandle) {
+		return nil, errors.New("user handle does not match credential owner")
+	}
+
+	return user, nil
+}
+
+// StartSessionSweeper periodically removes expired sessions until the returned stop func is called
+func StartSessionSweeper(sweeper SessionSweeper, interval time.Duration, log Logger) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := sweeper.DeleteExpiredSessions()
+				if err != nil {
+					log.Printf("[ERROR] Session Sweeper: Failed to delete expired sessions: %v", err)
+					continue
+				}
+				if deleted > 0 {
+					log.Printf("[DEBUG] Session Sweeper: Deleted %d expired sessions", deleted)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// sessionsCollection is the system collection holding in-flight WebAuthn ceremonies
+const sessionsCollection = "_webauthnSessions"
+
+// DBStore is a PasskeyStore that persists ceremony sessions in a PocketBase collection
+// so they survive restarts and expire on their own
+type DBStore struct {
+	log Logger
+	app core.App
+	ttl time.Duration
+}
+
+// NewDBStore creates a collection backed store. ttl is used for sessions
+// whose webauthn.SessionData doesn't carry an expiry.
+func NewDBStore(log Logger, app core.App, ttl time.Duration) *DBStore {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+
+	return &DBStore{
+		log: log,
+		app: app,
+		ttl: ttl,
+	}
+}
+
+func (d *DBStore) GenSessionID() (string, error) {
+	return genSessionID()
+}
+
+func (d *DBStore) GetSession(token string) (LocalSession, bool) {
+	record, err := d.app.FindFirstRecordByData(sessionsCollection, "sessionId", token)
+	if err != nil {
+		d.log.Printf("[DEBUG] GetSession: session not found: %s", token)
+		return LocalSession{}, false
+	}
+
+	if record.GetDateTime("expires").Time().Before(time.Now()) {
+		d.log.Printf("[DEBUG] GetSession: session expired: %s", token)
+		if err := d.app.Delete(record); err != nil {
+			d.log.Printf("[ERROR] GetSession: Failed to delete expired session: %v", err)
+		}
+		return LocalSession{}, false
+	}
+
+	var data webauthn.SessionData
+	if err := record.UnmarshalJSONField("data", &data); err != nil {
+		d.log.Printf("[ERROR] GetSession: Failed to decode session data: %v", err)
+		return LocalSession{}, false
+	}
+
+	return LocalSession{
+		SessionData: data,
+		Email:       record.GetString("email"),
+		UserId:      record.GetString("userId"),
+		MfaId:       record.GetString("mfaId"),
+	}, true
+}
+
+func (d *DBStore) SaveSession(token string, data LocalSession) {
+	d.log.Printf("[DEBUG] SaveSession: %s - %s", token, data.Email)
+
+	collection, err := d.app.FindCachedCollectionByNameOrId(sessionsCollection)
+	if err != nil {
+		d.log.Printf("[ERROR] SaveSession: Failed to find sessions collection: %v", err)
+		return
+	}
+
+	expires := data.SessionData.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(d.ttl)
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("sessionId", token)
+	record.Set("email", data.Email)
+	record.Set("userId", data.UserId)
+	record.Set("mfaId", data.MfaId)
+	record.Set("data", data.SessionData)
+	record.Set("expires", expires)
+
+	if err := d.app.Save(record); err != nil {
+		d.log.Printf("[ERROR] SaveSession: Failed to save session: %v", err)
+	}
+}
+
+func (d *DBStore) DeleteSession(token string) {
+	d.log.Printf("[DEBUG] DeleteSession: %v", token)
+
+	record, err := d.app.FindFirstRecordByData(sessionsCollection, "sessionId", token)
+	if err != nil {
+		return
+	}
+
+	if err := d.app.Delete(record); err != nil {
+		d.log.Printf("[ERROR] DeleteSession: Failed to delete session: %v", err)
+	}
+}
+
+// DeleteExpiredSessions removes every session past its expiry
+func (d *DBStore) DeleteExpiredSessions() (int, error) {
+	records, err := d.app.FindAllRecords(sessionsCollection,
+		dbx.NewExp("[[expires]] < {:now}", dbx.Params{"now": types.NowDateTime().String()}),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, record := range records {
+		if err := d.app.Delete(record); err != nil {
+			return i, err
+		}
+	}
+
+	return len(records), nil
+}
+
+func (d *DBStore) CreateUser(txApp core.App, email string, userHandle []byte) (PasskeyUser, error) {
+	d.log.Printf("[DEBUG] CreateUser: %v", email)
+
+	return createUserWithHandle(txApp, email, base64.RawURLEncoding.EncodeToString(userHandle))
+}
+
+func (d *DBStore) GetUserByEmail(email string) (PasskeyUser, error) {
+	d.log.Printf("[DEBUG] GetUserByEmail: %v", email)
+
+	return getUserByEmail(d.app, email)
+}
+
+func (d *DBStore) GetUser(recordId string) (PasskeyUser, error) {
+	d.log.Printf("[DEBUG] GetUser: %v", recordId)
+
+	return getUser(d.app, recordId)
+}
+
+func (d *DBStore) GetUserByCredential(rawID, userHandle []byte) (PasskeyUser, error) {
+	d.log.Printf("[DEBUG] GetUserByCredential: %s", base64.RawURLEncoding.EncodeToString(rawID))
+
+	return getUserByCredential(d.app, rawID, userHandle)
+}
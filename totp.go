@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// totpSecretField holds the active TOTP secret, encrypted when keys are configured
+	totpSecretField = "totpSecret"
+	// totpLastUsedField stores the Unix time of the time-step of the last
+	// accepted TOTP code
+	totpLastUsedField = "totpLastUsed"
+	// totpPendingSecretField holds a generated secret until it is confirmed
+	totpPendingSecretField = "totpPendingSecret"
+	// totpDigitsField, totpPeriodField and totpAlgorithmField hold the
+	// parameters the active secret was enrolled with
+	totpDigitsField    = "totpDigits"
+	totpPeriodField    = "totpPeriod"
+	totpAlgorithmField = "totpAlgorithm"
+)
+
+// maxTOTPSkew bounds TOTP_SKEW, as every period of drift accepted widens the
+// window for guessing a code
+const maxTOTPSkew = 3
+
+// ErrTOTPReplay is returned when a TOTP code for an already used time-step is presented again
+var ErrTOTPReplay = errors.New("totp code already used")
+
+// totpParams are the parameters codes of a TOTP secret are generated with
+type totpParams struct {
+	Digits    otp.Digits
+	Period    uint
+	Algorithm otp.Algorithm
+}
+
+// configTOTPParams returns the configured parameters of new enrollments
+func configTOTPParams(config *AppConfig) totpParams {
+	return totpParams{
+		Digits:    config.TOTPDigits,
+		Period:    config.TOTPPeriod,
+		Algorithm: config.TOTPAlgorithm,
+	}
+}
+
+// userTOTPParams returns the parameters the active secret of record was
+// enrolled with, or the configured ones for enrollments from before they
+// were stored
+func userTOTPParams(config *AppConfig, record *core.Record) totpParams {
+	params := configTOTPParams(config)
+
+	if digits := record.GetInt(totpDigitsField); digits > 0 {
+		params.Digits = otp.Digits(digits)
+	}
+	if period := record.GetInt(totpPeriodField); period > 0 {
+		params.Period = uint(period)
+	}
+	if algorithm, err := parseTOTPAlgorithm(record.GetString(totpAlgorithmField)); err == nil {
+		params.Algorithm = algorithm
+	}
+
+	return params
+}
+
+// setUserTOTPParams stores params as the enrollment parameters of record
+func setUserTOTPParams(record *core.Record, params totpParams) {
+	record.Set(totpDigitsField, params.Digits.Length())
+	record.Set(totpPeriodField, params.Period)
+	record.Set(totpAlgorithmField, params.Algorithm.String())
+}
+
+// clearUserTOTPParams removes the enrollment parameters of record
+func clearUserTOTPParams(record *core.Record) {
+	record.Set(totpDigitsField, 0)
+	record.Set(totpPeriodField, 0)
+	record.Set(totpAlgorithmField, "")
+}
+
+// newTOTPGenerateOpts returns the key generation options for a secret with
+// the given parameters
+func newTOTPGenerateOpts(issuer string, accountName string, params totpParams) totp.GenerateOpts {
+	return totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: accountName,
+		Period:      params.Period,
+		Digits:      params.Digits,
+		Algorithm:   params.Algorithm,
+	}
+}
+
+// matchTOTPCode validates passcode within skew periods of now and returns the
+// Unix time of the time-step the code belongs to
+//
+// Every candidate step is checked individually because totp.ValidateCustom
+// only reports whether some step within the skew matched, not which one.
+func matchTOTPCode(params totpParams, skew uint, passcode string, secret string, now time.Time) (int64, bool) {
+	opts := totp.ValidateOpts{
+		Period:    params.Period,
+		Skew:      0,
+		Digits:    params.Digits,
+		Algorithm: params.Algorithm,
+	}
+
+	period := int64(params.Period)
+	current := now.Unix() / period
+
+	for step := current - int64(skew); step <= current+int64(skew); step++ {
+		stepTime := step * period
+		ok, err := totp.ValidateCustom(passcode, secret, time.Unix(stepTime, 0).UTC(), opts)
+		if err == nil && ok {
+			return stepTime, true
+		}
+	}
+
+	return 0, false
+}
+
+// consumeTOTPCode records usedAt as the time-step of the user's last accepted
+// TOTP code, failing with ErrTOTPReplay when it is not newer than the stored
+// one
+func consumeTOTPCode(app core.App, userId string, usedAt int64) error {
+	return app.RunInTransaction(func(txApp core.App) error {
+		record, err := txApp.FindRecordById("users", userId)
+		if err != nil {
+			return err
+		}
+
+		if int64(record.GetInt(totpLastUsedField)) >= usedAt {
+			return ErrTOTPReplay
+		}
+
+		record.Set(totpLastUsedField, usedAt)
+
+		return txApp.Save(record)
+	})
+}
+
+// getTOTPSecret returns the decrypted TOTP secret stored in field of record
+func getTOTPSecret(cipher *SecretCipher, record *core.Record, field string) (string, error) {
+	return cipher.Decrypt(record.GetString(field), record.Id)
+}
+
+// setTOTPSecret encrypts secret into field of record, bound to the record id
+func setTOTPSecret(cipher *SecretCipher, record *core.Record, field string, secret string) error {
+	value, err := cipher.Encrypt(secret, record.Id)
+	if err != nil {
+		return err
+	}
+
+	record.Set(field, value)
+
+	return nil
+}
@@ -6,18 +6,43 @@ import (
 	"reflect"
 
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pocketbase/pocketbase/core"
 )
 
 // UserTotp represents TOTP login request
 type UserTotp struct {
 	MfaId    string `json:"mfaId" form:"mfaId"`
 	Passcode string `json:"passcode" form:"passcode"`
+	// RecoveryCode may be sent instead of Passcode
+	RecoveryCode string `json:"recoveryCode,omitempty" form:"recoveryCode"`
+}
+
+// TOTPKeyResponse is the JSON representation of a TOTP key, for users
+// setting up an authenticator app on the same device
+type TOTPKeyResponse struct {
+	URI         string `json:"uri"`
+	Secret      string `json:"secret"`
+	Issuer      string `json:"issuer"`
+	AccountName string `json:"accountName"`
+	Digits      int    `json:"digits"`
+	Period      uint64 `json:"period"`
+	Algorithm   string `json:"algorithm"`
+}
+
+// RecoveryCodesResponse returns a freshly generated batch of TOTP recovery codes
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
 }
 
 // LocalSession represents a WebAuthn session stored in memory
 type LocalSession struct {
 	SessionData webauthn.SessionData
 	Email       string
+	// UserId is empty for a sign-up, whose account is only created once its
+	// first passkey is registered
+	UserId string
+	// MfaId is the pending _mfas record a passkey second factor completes
+	MfaId string
 }
 
 // Logger interface for logging operations
@@ -28,19 +53,61 @@ type Logger interface {
 // PasskeyUser extends webauthn.User with credential management
 type PasskeyUser interface {
 	webauthn.User
-	AddCredential(*webauthn.Credential, string) error
-	UpdateCredential(*webauthn.Credential) error
+	RecordID() string
+	AddCredential(*webauthn.Credential) error
+	UpdateCredential(core.App, *webauthn.Credential) error
+	FlagCloneWarning(app core.App, credentialID []byte) error
 }
 
-// PasskeyStore interface for managing users and sessions
-type PasskeyStore interface {
-	GetOrCreateUser(email string) (PasskeyUser, error)
+// PasskeyUserLookup finds existing users without side effects.
+// Missing users are reported with ErrUserNotFound.
+type PasskeyUserLookup interface {
+	GetUser(recordId string) (PasskeyUser, error)
+	GetUserByEmail(email string) (PasskeyUser, error)
+	GetUserByCredential(rawID, userHandle []byte) (PasskeyUser, error)
+}
+
+// PasskeyUserCreator creates new user accounts
+type PasskeyUserCreator interface {
+	// CreateUser creates the account of email with the user handle its first
+	// passkey is registered for. txApp allows creating it inside the
+	// caller's transaction.
+	CreateUser(txApp core.App, email string, userHandle []byte) (PasskeyUser, error)
+}
+
+// PasskeySessionStore keeps in-flight WebAuthn ceremony sessions
+type PasskeySessionStore interface {
 	GenSessionID() (string, error)
 	GetSession(token string) (LocalSession, bool)
 	SaveSession(token string, data LocalSession)
 	DeleteSession(token string)
 }
 
+// PasskeyStore interface for managing users and sessions
+type PasskeyStore interface {
+	PasskeyUserLookup
+	PasskeyUserCreator
+	PasskeySessionStore
+}
+
+// SessionSweeper is implemented by stores that can purge expired sessions in bulk
+type SessionSweeper interface {
+	DeleteExpiredSessions() (int, error)
+}
+
+// PasskeyCredentialInfo is the API representation of a stored passkey
+type PasskeyCredentialInfo struct {
+	Id             string   `json:"id"`
+	Name           string   `json:"name"`
+	AAGUID         string   `json:"aaguid"`
+	Transports     []string `json:"transports"`
+	BackupEligible bool     `json:"backupEligible"`
+	BackupState    bool     `json:"backupState"`
+	CloneWarning   bool     `json:"cloneWarning"`
+	Created        string   `json:"created"`
+	LastUsed       string   `json:"lastUsed"`
+}
+
 // CredentialCreationResponse represents WebAuthn credential response
 type CredentialCreationResponse struct {
 	PublicKeyCredential
@@ -0,0 +1,45 @@
+import { pb } from '$lib/pocketbase'
+import { startAuthentication } from '@simplewebauthn/browser'
+
+// code of the 401 body sent when an operation needs a recent strong authentication
+export const STEP_UP_REQUIRED = 'step_up_required'
+
+export function isStepUpChallenge(body: any): boolean {
+    return body?.code === STEP_UP_REQUIRED
+}
+
+// stepUp confirms the signed-in user with a passkey or a TOTP passcode,
+// whichever the challenge offers, and reports whether it succeeded
+export async function stepUp(methods: string[]): Promise<boolean> {
+    try {
+        if (methods.includes('passkey')) {
+            // the session key only comes back as a header, which pb.send hides
+            const response = await fetch(pb.buildURL('/api/pb-experiments/passkey/reauthStart'), {
+                method: 'POST',
+                headers: { Authorization: `Bearer ${pb.authStore.token}` },
+            })
+            if (!response.ok) return false
+
+            const options = await response.json()
+            const reauthKey = response.headers.get('Reauth-Key') ?? ''
+            const assertion = await startAuthentication({ optionsJSON: options.publicKey })
+            await pb.send('/api/pb-experiments/step-up', {
+                method: 'POST',
+                headers: { 'Reauth-Key': reauthKey },
+                body: JSON.stringify(assertion),
+            })
+            return true
+        }
+
+        const passcode = window.prompt('Enter a code from your authenticator app to continue')
+        if (!passcode) return false
+
+        await pb.send('/api/pb-experiments/step-up', {
+            method: 'POST',
+            body: JSON.stringify({ passcode }),
+        })
+        return true
+    } catch (err) {
+        return false
+    }
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"maps"
 	"net/http"
 )
 
@@ -24,4 +26,46 @@ func JSONErrorResponse(w http.ResponseWriter, message string, status int) {
 		Error:   http.StatusText(status),
 		Message: message,
 	}, status)
-}
\ No newline at end of file
+}
+
+// bufferedResponse holds back a response so that it can be discarded when
+// the work it reports on fails after it was written
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// newBufferedResponse creates a buffer starting out with a copy of header
+func newBufferedResponse(header http.Header) *bufferedResponse {
+	return &bufferedResponse{header: header.Clone()}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// flushTo sends the held back response to w, if anything was written
+func (b *bufferedResponse) flushTo(w http.ResponseWriter) error {
+	if b.status == 0 {
+		return nil
+	}
+
+	maps.Copy(w.Header(), b.header)
+	w.WriteHeader(b.status)
+	_, err := w.Write(b.body.Bytes())
+	return err
+}